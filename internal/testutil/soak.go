@@ -0,0 +1,22 @@
+package testutil
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Soak returns how long a soak test should run for, as given by the
+// SOAK_TEST_DURATION environment variable (e.g. "10m"). It skips the test if
+// the variable is empty.
+func Soak(t *testing.T) time.Duration {
+	value := os.Getenv("SOAK_TEST_DURATION")
+	if value == "" {
+		t.Skip("soak")
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		t.Fatalf("invalid SOAK_TEST_DURATION %q: %s", value, err)
+	}
+	return duration
+}
@@ -3,17 +3,24 @@ package messagequeue
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 
 	"github.com/ipfs/go-protocolnetwork/pkg/network"
 )
 
 var log = logging.Logger("protocolnetwork/messagequeue")
 
+// metrics are published via expvar, aggregated across all queues
+var metrics = expvar.NewMap("protocolnetwork.messagequeue")
+
 // MessageNetwork is any network that can connect peers and generate a message
 // sender.
 type MessageNetwork[MessageType network.Message[MessageType]] interface {
@@ -28,6 +35,17 @@ type Notifier interface {
 	HandleFinished()
 }
 
+// ProtocolChangeHandler can optionally be implemented by a MessageBuilder that
+// needs to know which protocol version its messages will be sent with. It is
+// called from the queue's goroutine whenever the protocol negotiated with the
+// peer changes (including the first time a sender is opened), before the next
+// message is built, so pending messages can be rebuilt for the new version.
+// A message already built when its send reconnects to the peer is still sent
+// as built, serialized by the handler for the newly negotiated protocol.
+type ProtocolChangeHandler interface {
+	ProtocolChanged(protocol.ID)
+}
+
 type MessageSpec[MessageType network.Message[MessageType]] func() (MessageType, Notifier, error)
 
 type MessageBuilder[MessageType network.Message[MessageType], BuildParams any] interface {
@@ -42,8 +60,14 @@ type MessageQueue[MessageType network.Message[MessageType], BuildParams any] str
 	ctx     context.Context
 
 	outgoingWork chan struct{}
+	migrations   chan struct{}
+	pauses       chan struct{}
 	done         chan struct{}
 	doneOnce     sync.Once
+	paused       int32
+
+	migrationLk sync.Mutex
+	migrateTo   peer.ID
 
 	// internal do not touch outside go routines
 	sender     network.MessageSender[MessageType]
@@ -51,6 +75,10 @@ type MessageQueue[MessageType network.Message[MessageType], BuildParams any] str
 	onStartup  func()
 	onShutdown func()
 	opts       *network.MessageSenderOpts
+	protocol   protocol.ID
+
+	state         State
+	onStateChange StateChangeHook
 }
 
 // New creats a new MessageQueue.
@@ -68,6 +96,8 @@ func New[MessageType network.Message[MessageType], BuildParams any](
 		p:            p,
 		builder:      builder,
 		outgoingWork: make(chan struct{}, 1),
+		migrations:   make(chan struct{}, 1),
+		pauses:       make(chan struct{}, 1),
 		done:         make(chan struct{}),
 		opts:         opts,
 		onStartup:    onStartup,
@@ -89,6 +119,48 @@ func (mq *MessageQueue[MessageType, BuildParams]) Startup() {
 	go mq.runQueue()
 }
 
+// Migrate moves the queue to a new peer ID, e.g. when the peer re-identifies.
+// Pending messages are kept and sent to the new peer, over a new sender. It
+// does not block: the queue switches peers before it sends its next message,
+// or when it starts up if called before Startup.
+func (mq *MessageQueue[MessageType, BuildParams]) Migrate(p peer.ID) {
+	mq.migrationLk.Lock()
+	mq.migrateTo = p
+	mq.migrationLk.Unlock()
+	select {
+	case mq.migrations <- struct{}{}:
+	default:
+	}
+}
+
+// Pause stops the queue sending messages, without shutting it down. Messages
+// can still be built while the queue is paused, and are sent once it is
+// resumed. A send already in progress finishes first.
+func (mq *MessageQueue[MessageType, BuildParams]) Pause() {
+	mq.setPaused(true)
+}
+
+// Resume restarts sending after Pause
+func (mq *MessageQueue[MessageType, BuildParams]) Resume() {
+	mq.setPaused(false)
+}
+
+func (mq *MessageQueue[MessageType, BuildParams]) setPaused(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(&mq.paused, value)
+	select {
+	case mq.pauses <- struct{}{}:
+	default:
+	}
+}
+
+func (mq *MessageQueue[MessageType, BuildParams]) isPaused() bool {
+	return atomic.LoadInt32(&mq.paused) == 1
+}
+
 // Shutdown stops the processing of messages for a message queue.
 func (mq *MessageQueue[MessageType, BuildParams]) Shutdown() {
 	mq.doneOnce.Do(func() {
@@ -96,8 +168,15 @@ func (mq *MessageQueue[MessageType, BuildParams]) Shutdown() {
 	})
 }
 
+// runQueue runs the queue's state machine until the queue is closed. Each
+// state waits for its own events, and moves the queue on by transitioning.
 func (mq *MessageQueue[MessageType, BuildParams]) runQueue() {
+	mq.migrate()
+	// label the queue so profiles can be broken down by peer
+	mq.setLabels()
+	metrics.Add("active_queues", 1)
 	defer func() {
+		metrics.Add("active_queues", -1)
 		if mq.onShutdown != nil {
 			mq.onShutdown()
 		}
@@ -105,17 +184,51 @@ func (mq *MessageQueue[MessageType, BuildParams]) runQueue() {
 	if mq.onStartup != nil {
 		mq.onStartup()
 	}
+	mq.transition(StateIdle)
 	for {
-		select {
-		case <-mq.outgoingWork:
-			mq.sendMessage()
-		case <-mq.done:
+		switch mq.State() {
+		case StateIdle:
+			if mq.isPaused() {
+				mq.transition(StatePaused)
+				continue
+			}
+			select {
+			case <-mq.outgoingWork:
+				mq.transition(StateSending)
+			case <-mq.migrations:
+				mq.migrate()
+			case <-mq.pauses:
+			case <-mq.done:
+				mq.transition(StateDraining)
+			case <-mq.ctx.Done():
+				mq.transition(StateClosed)
+			}
+		case StateSending:
+			mq.sendMessages()
+			mq.transition(StateIdle)
+		case StatePaused:
+			if !mq.isPaused() {
+				mq.transition(StateIdle)
+				continue
+			}
+			// messages built while paused stay signalled until resumed
+			select {
+			case <-mq.migrations:
+				mq.migrate()
+			case <-mq.pauses:
+			case <-mq.done:
+				mq.transition(StateDraining)
+			case <-mq.ctx.Done():
+				mq.transition(StateClosed)
+			}
+		case StateDraining:
 			select {
 			case <-mq.outgoingWork:
 				for {
 					_, notifier, err := mq.extractOutgoingMessage()
 					if err == nil {
-						notifier.HandleError(fmt.Errorf("message queue shutdown"))
+						notifier.HandleError(ErrShutdown)
+						metrics.Add("messages_drained", 1)
 						notifier.HandleFinished()
 					} else {
 						break
@@ -123,11 +236,8 @@ func (mq *MessageQueue[MessageType, BuildParams]) runQueue() {
 				}
 			default:
 			}
-			if mq.sender != nil {
-				mq.sender.Reset()
-			}
-			return
-		case <-mq.ctx.Done():
+			mq.transition(StateClosed)
+		case StateClosed:
 			if mq.sender != nil {
 				_ = mq.sender.Reset()
 			}
@@ -136,6 +246,28 @@ func (mq *MessageQueue[MessageType, BuildParams]) runQueue() {
 	}
 }
 
+func (mq *MessageQueue[MessageType, BuildParams]) setLabels() {
+	pprof.SetGoroutineLabels(pprof.WithLabels(mq.ctx, pprof.Labels("peer", mq.p.String())))
+}
+
+// migrate applies any pending migration, dropping the sender to the old peer
+// so the next message opens one to the new peer
+func (mq *MessageQueue[MessageType, BuildParams]) migrate() {
+	mq.migrationLk.Lock()
+	p := mq.migrateTo
+	mq.migrateTo = ""
+	mq.migrationLk.Unlock()
+	if p == "" || p == mq.p {
+		return
+	}
+	if mq.sender != nil {
+		_ = mq.sender.Reset()
+		mq.sender = nil
+	}
+	mq.p = p
+	mq.setLabels()
+}
+
 func (mq *MessageQueue[MessageType, BuildParams]) signalWork() {
 	select {
 	case mq.outgoingWork <- struct{}{}:
@@ -143,17 +275,17 @@ func (mq *MessageQueue[MessageType, BuildParams]) signalWork() {
 	}
 }
 
-var errEmptyMessage = errors.New("empty Message")
+// ErrEmptyMessage is returned by a MessageBuilder's NextMessage when it has
+// nothing to send. The queue skips the send without logging an error.
+var ErrEmptyMessage = errors.New("empty Message")
+
+// ErrShutdown is reported to the notifiers of messages still pending when the
+// queue shuts down
+var ErrShutdown = errors.New("message queue shutdown")
 
 func (mq *MessageQueue[MessageType, BuildParams]) extractOutgoingMessage() (MessageType, Notifier, error) {
 	// grab outgoing message
-	spec, hasMore, err := mq.builder.NextMessage()
-	if hasMore {
-		select {
-		case mq.outgoingWork <- struct{}{}:
-		default:
-		}
-	}
+	spec, _, err := mq.builder.NextMessage()
 	if err != nil {
 		var emptyMessage MessageType
 		return emptyMessage, nil, err
@@ -161,36 +293,88 @@ func (mq *MessageQueue[MessageType, BuildParams]) extractOutgoingMessage() (Mess
 	return spec()
 }
 
-func (mq *MessageQueue[MessageType, BuildParams]) sendMessage() {
-	message, notifier, err := mq.extractOutgoingMessage()
+// maxMessagesPerWakeup is the most messages sent each time the queue is
+// signalled before it yields back to its select loop
+const maxMessagesPerWakeup = 16
+
+// sendMessages sends pending messages until the builder has no more, the
+// queue shuts down, or maxMessagesPerWakeup is reached, rather than going
+// round the select loop once per message
+func (mq *MessageQueue[MessageType, BuildParams]) sendMessages() {
+	for i := 0; i < maxMessagesPerWakeup; i++ {
+		// a failed send shuts the queue down, and the work signal may be
+		// picked over done, so check for shutdown before every send
+		select {
+		case <-mq.done:
+			// leave the remaining work signalled so it is drained on shutdown
+			mq.signalWork()
+			return
+		case <-mq.ctx.Done():
+			return
+		default:
+		}
+		if mq.isPaused() {
+			// and sent once the queue is resumed
+			mq.signalWork()
+			return
+		}
+		// messages built after a migration must not go to the old peer
+		mq.migrate()
+		if !mq.sendMessage() {
+			return
+		}
+	}
+	mq.signalWork()
+}
 
+// sendMessage sends the next message, returning whether the builder has more
+// messages pending
+func (mq *MessageQueue[MessageType, BuildParams]) sendMessage() bool {
+	spec, hasMore, err := mq.builder.NextMessage()
 	if err != nil {
-		if err != errEmptyMessage {
+		if err != ErrEmptyMessage {
 			log.Errorf("Unable to assemble GraphSync message: %s", err.Error())
 		}
-		return
+		return hasMore
+	}
+
+	// open the sender before building the message, so the builder learns
+	// about any protocol change before the message is assembled
+	senderErr := mq.initializeSender()
+
+	message, notifier, err := spec()
+	if err != nil {
+		log.Errorf("Unable to assemble GraphSync message: %s", err.Error())
+		return hasMore
 	}
 	notifier.HandleQueued()
 	defer notifier.HandleFinished()
 
-	err = mq.initializeSender()
+	err = senderErr
 	if err != nil {
 		log.Infof("cant open message sender to peer %s: %s", mq.p, err)
 		// TODO: cant connect, what now?
 		notifier.HandleError(fmt.Errorf("cant open message sender to peer %s: %w", mq.p, err))
+		metrics.Add("messages_failed", 1)
 		mq.Shutdown()
-		return
+		return hasMore
 	}
 	if err = mq.sender.SendMsg(mq.ctx, message); err != nil {
 		// If the message couldn't be sent, the networking layer will
 		// emit a Disconnect event and the MessageQueue will get cleaned up
 		log.Infof("Could not send message to peer %s: %s", mq.p, err)
-		notifier.HandleError(fmt.Errorf("expended retries on SendMsg(%s)", mq.p))
+		notifier.HandleError(fmt.Errorf("expended retries on SendMsg(%s): %w", mq.p, err))
+		metrics.Add("messages_failed", 1)
 		mq.Shutdown()
-		return
+		return hasMore
 	}
 
 	notifier.HandleSent()
+	metrics.Add("messages_sent", 1)
+
+	// the sender may have reconnected while sending
+	mq.updateProtocol()
+	return hasMore
 }
 
 func (mq *MessageQueue[MessageType, BuildParams]) initializeSender() error {
@@ -202,5 +386,17 @@ func (mq *MessageQueue[MessageType, BuildParams]) initializeSender() error {
 		return err
 	}
 	mq.sender = nsender
+	mq.updateProtocol()
 	return nil
 }
+
+func (mq *MessageQueue[MessageType, BuildParams]) updateProtocol() {
+	protocol := mq.sender.Protocol()
+	if protocol == mq.protocol {
+		return
+	}
+	mq.protocol = protocol
+	if handler, ok := mq.builder.(ProtocolChangeHandler); ok {
+		handler.ProtocolChanged(protocol)
+	}
+}
@@ -2,6 +2,7 @@ package messagequeue_test
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"sync"
 	"testing"
@@ -137,6 +138,484 @@ func TestProcessingNotification(t *testing.T) {
 	notifier.ExpectHandleFinished(ctx, t)
 }
 
+func TestProtocolChangeNotification(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	bc := &protocolTrackingBuilder{
+		MessageBuilder:   testutil.NewMessageBuilder(),
+		protocolsChanged: make(chan protocol.ID, 1),
+	}
+
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.Startup()
+	id := testutil.RandomBytes(100)
+	payload := testutil.RandomBytes(100)
+	waitGroup.Add(1)
+
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(id)
+		b.SetPayload(payload)
+	})
+
+	var changed protocol.ID
+	testutil.AssertReceive(ctx, t, bc.protocolsChanged, &changed, "protocol change was not reported")
+	require.Equal(t, protocol.ID("mock"), changed)
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+
+	// the protocol has not changed, so a second message should not report it again
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+		b.SetPayload(payload)
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	testutil.AssertChannelEmpty(t, bc.protocolsChanged, "protocol change should not be reported twice")
+}
+
+func TestProtocolChangeAfterReconnect(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	// the first send reconnects and negotiates a different protocol
+	messageSender := &reconnectingMessageSender{
+		fakeMessageSender: &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent},
+		protocol:          testutil.ProtocolMockV2,
+		reconnectTo:       testutil.ProtocolMockV1,
+	}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	bc := &eventRecordingBuilder{
+		MessageBuilder: testutil.NewMessageBuilder(),
+		events:         make(chan string, 10),
+	}
+
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+	payload := testutil.RandomBytes(100)
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+		b.SetPayload(payload)
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+		b.SetPayload(payload)
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+
+	// the builder learns of the new protocol before the next message is built
+	expected := []string{
+		"protocol " + string(testutil.ProtocolMockV2),
+		"build",
+		"protocol " + string(testutil.ProtocolMockV1),
+		"build",
+	}
+	for _, expectedEvent := range expected {
+		var event string
+		testutil.AssertReceive(ctx, t, bc.events, &event, "builder event was not recorded")
+		require.Equal(t, expectedEvent, event)
+	}
+	testutil.AssertChannelEmpty(t, bc.events, "no further builder events should be recorded")
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &peerRecordingNetwork{messageSender, make(chan peer.ID, 2)}
+	bc := testutil.NewMessageBuilder()
+
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peers[0], messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.Startup()
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	var senderPeer peer.ID
+	testutil.AssertReceive(ctx, t, messageNetwork.senderPeers, &senderPeer, "sender was not opened")
+	require.Equal(t, peers[0], senderPeer)
+
+	// the sender to the old peer is dropped, and the next message goes to the new peer
+	messageQueue.Migrate(peers[1])
+	testutil.AssertDoesReceive(ctx, t, resetChan, "sender to old peer was not reset")
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	testutil.AssertReceive(ctx, t, messageNetwork.senderPeers, &senderPeer, "sender was not opened")
+	require.Equal(t, peers[1], senderPeer)
+}
+
+func TestMigrateBeforeStartup(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &peerRecordingNetwork{messageSender, make(chan peer.ID, 2)}
+	bc := testutil.NewMessageBuilder()
+
+	// migrating a queue that hasn't started doesn't block, and it starts on the new peer
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peers[0], messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.Migrate(peers[1])
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+	})
+	messageQueue.Startup()
+	var senderPeer peer.ID
+	testutil.AssertReceive(ctx, t, messageNetwork.senderPeers, &senderPeer, "sender was not opened")
+	require.Equal(t, peers[1], senderPeer)
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	testutil.AssertChannelEmpty(t, resetChan, "no sender should have been reset")
+}
+
+func TestMigrateBetweenSends(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	messageNetwork := &peerRecordingNetwork{messageSender, make(chan peer.ID, 2)}
+	bc := &multiMessageBuilder{}
+
+	messageQueue := messagequeue.New[*testutil.Message, []byte](ctx, peers[0], messageNetwork, bc, messageSenderOpts, nil, nil)
+	ids := [][]byte{testutil.RandomBytes(10), testutil.RandomBytes(10), testutil.RandomBytes(10)}
+	for _, id := range ids {
+		messageQueue.BuildMessage(id)
+	}
+	messageQueue.Startup()
+	var senderPeer peer.ID
+	testutil.AssertReceive(ctx, t, messageNetwork.senderPeers, &senderPeer, "sender was not opened")
+	require.Equal(t, peers[0], senderPeer)
+
+	// the first message is being sent, and the rest of the batch goes to the new peer
+	messageQueue.Migrate(peers[1])
+	var sent *testutil.Message
+	testutil.AssertReceive(ctx, t, messagesSent, &sent, "message was not sent")
+	require.Equal(t, ids[0], sent.Id)
+	testutil.AssertDoesReceive(ctx, t, resetChan, "sender to old peer was not reset")
+	testutil.AssertReceive(ctx, t, messageNetwork.senderPeers, &senderPeer, "sender was not opened")
+	require.Equal(t, peers[1], senderPeer)
+	for _, id := range ids[1:] {
+		testutil.AssertReceive(ctx, t, messagesSent, &sent, "message was not sent")
+		require.Equal(t, id, sent.Id)
+	}
+	testutil.AssertChannelEmpty(t, messageNetwork.senderPeers, "only one sender should be opened to the new peer")
+}
+
+func TestStateTransitions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message, 1)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	bc := testutil.NewMessageBuilder()
+
+	type transition struct{ from, to messagequeue.State }
+	transitions := make(chan transition, 10)
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.OnStateChange(func(from, to messagequeue.State) {
+		transitions <- transition{from, to}
+	})
+	require.Equal(t, messagequeue.StateNew, messageQueue.State())
+
+	expectTransition := func(from, to messagequeue.State) {
+		var next transition
+		testutil.AssertReceive(ctx, t, transitions, &next, "state did not change")
+		require.Equal(t, transition{from, to}, next)
+	}
+
+	messageQueue.Startup()
+	expectTransition(messagequeue.StateNew, messagequeue.StateIdle)
+
+	waitGroup.Add(1)
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(testutil.RandomBytes(100))
+	})
+	expectTransition(messagequeue.StateIdle, messagequeue.StateSending)
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	expectTransition(messagequeue.StateSending, messagequeue.StateIdle)
+
+	messageQueue.Shutdown()
+	expectTransition(messagequeue.StateIdle, messagequeue.StateDraining)
+	expectTransition(messagequeue.StateDraining, messagequeue.StateClosed)
+	require.Equal(t, messagequeue.StateClosed, messageQueue.State())
+}
+
+func TestPauseAndResume(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message, 1)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	errs := make(chan error, 1)
+	bc := &multiMessageBuilder{errors: errs}
+
+	type transition struct{ from, to messagequeue.State }
+	transitions := make(chan transition, 10)
+	messageQueue := messagequeue.New[*testutil.Message, []byte](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.OnStateChange(func(from, to messagequeue.State) {
+		transitions <- transition{from, to}
+	})
+	expectTransition := func(from, to messagequeue.State) {
+		var next transition
+		testutil.AssertReceive(ctx, t, transitions, &next, "state did not change")
+		require.Equal(t, transition{from, to}, next)
+	}
+
+	messageQueue.Startup()
+	expectTransition(messagequeue.StateNew, messagequeue.StateIdle)
+	messageQueue.Pause()
+	expectTransition(messagequeue.StateIdle, messagequeue.StatePaused)
+
+	// messages built while paused are held
+	id := testutil.RandomBytes(100)
+	messageQueue.BuildMessage(id)
+	time.Sleep(20 * time.Millisecond)
+	testutil.AssertChannelEmpty(t, messagesSent, "paused queue should not send")
+
+	// and sent on resume
+	waitGroup.Add(1)
+	messageQueue.Resume()
+	expectTransition(messagequeue.StatePaused, messagequeue.StateIdle)
+	expectTransition(messagequeue.StateIdle, messagequeue.StateSending)
+	var message *testutil.Message
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message was not sent on resume")
+	require.Equal(t, id, message.Id)
+	expectTransition(messagequeue.StateSending, messagequeue.StateIdle)
+
+	// shutting down a paused queue drains its held messages
+	messageQueue.Pause()
+	expectTransition(messagequeue.StateIdle, messagequeue.StatePaused)
+	messageQueue.BuildMessage(testutil.RandomBytes(100))
+	messageQueue.Shutdown()
+	expectTransition(messagequeue.StatePaused, messagequeue.StateDraining)
+	expectTransition(messagequeue.StateDraining, messagequeue.StateClosed)
+	var err error
+	testutil.AssertReceive(ctx, t, errs, &err, "held message was not drained")
+	require.ErrorIs(t, err, messagequeue.ErrShutdown)
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message, 1)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	bc := testutil.NewMessageBuilder()
+	// other tests' queues may still be running, so only check counters grow
+	sent := readMetric("messages_sent")
+
+	messageQueue := messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+	id := testutil.RandomBytes(100)
+	messageQueue.BuildMessage(func(b *testutil.SingleBuilder) {
+		b.SetID(id)
+	})
+	testutil.AssertDoesReceive(ctx, t, messagesSent, "message was not sent")
+	bc.Notifier(id).ExpectHandleFinished(ctx, t)
+	require.GreaterOrEqual(t, readMetric("messages_sent"), sent+1)
+	require.NotNil(t, expvar.Get("protocolnetwork.messagequeue").(*expvar.Map).Get("active_queues"))
+	messageQueue.Shutdown()
+}
+
+func readMetric(name string) int64 {
+	value := expvar.Get("protocolnetwork.messagequeue").(*expvar.Map).Get(name)
+	if value == nil {
+		return 0
+	}
+	return value.(*expvar.Int).Value()
+}
+
+func TestSendsAllPendingMessages(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan *testutil.Message)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	bc := &multiMessageBuilder{}
+
+	messageQueue := messagequeue.New[*testutil.Message, []byte](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+
+	// queue up more messages than are sent in a single wakeup before starting
+	ids := make([][]byte, 0, 40)
+	waitGroup.Add(1)
+	for i := 0; i < 40; i++ {
+		id := testutil.RandomBytes(100)
+		ids = append(ids, id)
+		messageQueue.BuildMessage(id)
+	}
+	messageQueue.Startup()
+
+	for _, id := range ids {
+		var message *testutil.Message
+		testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+		require.Equal(t, id, message.Id)
+	}
+	messageQueue.Shutdown()
+}
+
+func TestNotConnectedShutsDownQueue(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	// a sender that waits for the connection gives up with ErrNotConnected
+	// once the send timeout passes
+	peer := testutil.GeneratePeers(1)[0]
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, network.ErrNotConnected, nil, &waitGroup}
+	errs := make(chan error, 2)
+	bc := &multiMessageBuilder{errors: errs}
+
+	messageQueue := messagequeue.New[*testutil.Message, []byte](ctx, peer, messageNetwork, bc, messageSenderOpts, nil, nil)
+	waitGroup.Add(1)
+	messageQueue.BuildMessage(testutil.RandomBytes(100))
+	messageQueue.BuildMessage(testutil.RandomBytes(100))
+	messageQueue.Startup()
+
+	// the message being sent fails, and the queue shuts down rather than
+	// holding the rest until the peer connects
+	var err error
+	testutil.AssertReceive(ctx, t, errs, &err, "send did not fail")
+	require.ErrorIs(t, err, network.ErrNotConnected)
+	testutil.AssertReceive(ctx, t, errs, &err, "pending message was not drained")
+	require.ErrorIs(t, err, messagequeue.ErrShutdown)
+	require.Eventually(t, func() bool {
+		return messageQueue.State() == messagequeue.StateClosed
+	}, time.Second, 10*time.Millisecond)
+}
+
+// multiMessageBuilder builds a separate message for each id it is given,
+// reporting send errors on errors if it is set
+type multiMessageBuilder struct {
+	lk     sync.Mutex
+	ids    [][]byte
+	errors chan error
+}
+
+func (mmb *multiMessageBuilder) BuildMessage(id []byte) bool {
+	mmb.lk.Lock()
+	defer mmb.lk.Unlock()
+	mmb.ids = append(mmb.ids, id)
+	return true
+}
+
+func (mmb *multiMessageBuilder) NextMessage() (messagequeue.MessageSpec[*testutil.Message], bool, error) {
+	mmb.lk.Lock()
+	defer mmb.lk.Unlock()
+	if len(mmb.ids) == 0 {
+		return nil, false, messagequeue.ErrEmptyMessage
+	}
+	id := mmb.ids[0]
+	mmb.ids = mmb.ids[1:]
+	var notifier messagequeue.Notifier = nopNotifier{}
+	if mmb.errors != nil {
+		notifier = errorNotifier(mmb.errors)
+	}
+	return func() (*testutil.Message, messagequeue.Notifier, error) {
+		return &testutil.Message{Id: id}, notifier, nil
+	}, len(mmb.ids) > 0, nil
+}
+
+type nopNotifier struct{}
+
+func (nopNotifier) HandleQueued()     {}
+func (nopNotifier) HandleError(error) {}
+func (nopNotifier) HandleSent()       {}
+func (nopNotifier) HandleFinished()   {}
+
+type errorNotifier chan error
+
+func (en errorNotifier) HandleQueued()         {}
+func (en errorNotifier) HandleError(err error) { en <- err }
+func (en errorNotifier) HandleSent()           {}
+func (en errorNotifier) HandleFinished()       {}
+
+type protocolTrackingBuilder struct {
+	*testutil.MessageBuilder
+	protocolsChanged chan protocol.ID
+}
+
+func (ptb *protocolTrackingBuilder) ProtocolChanged(protocol protocol.ID) {
+	ptb.protocolsChanged <- protocol
+}
+
+// eventRecordingBuilder records protocol changes and message builds in the
+// order they happen
+type eventRecordingBuilder struct {
+	*testutil.MessageBuilder
+	events chan string
+}
+
+func (erb *eventRecordingBuilder) ProtocolChanged(protocol protocol.ID) {
+	erb.events <- "protocol " + string(protocol)
+}
+
+func (erb *eventRecordingBuilder) NextMessage() (messagequeue.MessageSpec[*testutil.Message], bool, error) {
+	spec, hasMore, err := erb.MessageBuilder.NextMessage()
+	if err != nil {
+		return nil, hasMore, err
+	}
+	return func() (*testutil.Message, messagequeue.Notifier, error) {
+		erb.events <- "build"
+		return spec()
+	}, hasMore, nil
+}
+
 const sendMessageTimeout = 10 * time.Minute
 const sendErrorBackoff = 100 * time.Millisecond
 const messageSendRetries = 10
@@ -168,6 +647,20 @@ func (fmn *fakeMessageNetwork) NewMessageSender(context.Context, peer.ID, *netwo
 	return nil, fmn.messageSenderError
 }
 
+type peerRecordingNetwork struct {
+	messageSender network.MessageSender[*testutil.Message]
+	senderPeers   chan peer.ID
+}
+
+func (prn *peerRecordingNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (prn *peerRecordingNetwork) NewMessageSender(_ context.Context, p peer.ID, _ *network.MessageSenderOpts) (network.MessageSender[*testutil.Message], error) {
+	prn.senderPeers <- p
+	return prn.messageSender, nil
+}
+
 var _ network.MessageSender[*testutil.Message] = (*fakeMessageSender)(nil)
 
 type fakeMessageSender struct {
@@ -187,6 +680,31 @@ func (fms *fakeMessageSender) Protocol() protocol.ID {
 	return "mock"
 }
 
+// reconnectingMessageSender negotiates a different protocol during its first
+// send, as a sender that reconnects mid-send would
+type reconnectingMessageSender struct {
+	*fakeMessageSender
+	lk          sync.Mutex
+	protocol    protocol.ID
+	reconnectTo protocol.ID
+}
+
+func (rms *reconnectingMessageSender) SendMsg(ctx context.Context, msg *testutil.Message) error {
+	err := rms.fakeMessageSender.SendMsg(ctx, msg)
+	rms.lk.Lock()
+	defer rms.lk.Unlock()
+	if rms.reconnectTo != "" {
+		rms.protocol, rms.reconnectTo = rms.reconnectTo, ""
+	}
+	return err
+}
+
+func (rms *reconnectingMessageSender) Protocol() protocol.ID {
+	rms.lk.Lock()
+	defer rms.lk.Unlock()
+	return rms.protocol
+}
+
 type fakeCloser struct {
 	fms    *fakeMessageSender
 	closed bool
@@ -0,0 +1,214 @@
+// Package messagequeuetest provides a conformance suite that MessageNetwork
+// and MessageSender implementations can run to verify they behave as
+// MessageQueue expects.
+package messagequeuetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue"
+	"github.com/ipfs/go-protocolnetwork/pkg/network"
+)
+
+// Harness is a MessageNetwork under test, connected to a peer whose received
+// messages can be observed
+type Harness[MessageType network.Message[MessageType]] struct {
+	// Network is the implementation under test
+	Network messagequeue.MessageNetwork[MessageType]
+	// Peer is a reachable remote peer
+	Peer peer.ID
+	// UnreachablePeer is a peer that messages can never be delivered to
+	UnreachablePeer peer.ID
+	// StalledPeer is an optional peer that accepts streams but never reads
+	// from them, so every send to it times out. Cases that need it are
+	// skipped when it is empty.
+	StalledPeer peer.ID
+	// Received receives every message delivered to Peer
+	Received <-chan MessageType
+	// NewMessage generates a new, unique message
+	NewMessage func() MessageType
+}
+
+// HarnessFactory sets up a new Harness for a single test. Any cleanup should be
+// registered with t.Cleanup.
+type HarnessFactory[MessageType network.Message[MessageType]] func(t *testing.T) Harness[MessageType]
+
+// Opts are the message sender options used throughout the suite
+var Opts = network.MessageSenderOpts{
+	MaxRetries:       3,
+	SendTimeout:      100 * time.Millisecond,
+	SendErrorBackoff: 10 * time.Millisecond,
+}
+
+// TestMessageNetwork runs the conformance suite against the MessageNetwork
+// implementation produced by newHarness
+func TestMessageNetwork[MessageType network.Message[MessageType]](t *testing.T, newHarness HarnessFactory[MessageType]) {
+	testCases := map[string]func(ctx context.Context, t *testing.T, h Harness[MessageType]){
+		"ConnectTo reachable peer": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			require.NoError(t, h.Network.ConnectTo(ctx, h.Peer))
+		},
+		"SendMsg delivers message": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			sender := newSender(ctx, t, h)
+			require.NotEmpty(t, sender.Protocol())
+			sent := h.NewMessage()
+			require.NoError(t, sender.SendMsg(ctx, sent))
+			expectReceived(ctx, t, h, sent)
+		},
+		"SendMsg after Reset": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			// MessageQueue resets its sender on shutdown, and the network
+			// layer resets on failed attempts -- a reset sender must be able
+			// to reconnect on the next send
+			sender := newSender(ctx, t, h)
+			first := h.NewMessage()
+			require.NoError(t, sender.SendMsg(ctx, first))
+			expectReceived(ctx, t, h, first)
+			require.NoError(t, sender.Reset())
+			second := h.NewMessage()
+			require.NoError(t, sender.SendMsg(ctx, second))
+			expectReceived(ctx, t, h, second)
+		},
+		"Close after send": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			sender := newSender(ctx, t, h)
+			sent := h.NewMessage()
+			require.NoError(t, sender.SendMsg(ctx, sent))
+			expectReceived(ctx, t, h, sent)
+			require.NoError(t, sender.Close())
+		},
+		"unreachable peer fails within retry budget": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			// a failure may surface either when opening the sender or when
+			// sending, but must not take much longer than the retries allow
+			budget := time.Duration(Opts.MaxRetries) * (Opts.SendTimeout + Opts.SendErrorBackoff)
+			start := time.Now()
+			opts := Opts
+			sender, err := h.Network.NewMessageSender(ctx, h.UnreachablePeer, &opts)
+			if err == nil {
+				err = sender.SendMsg(ctx, h.NewMessage())
+			}
+			require.Error(t, err)
+			require.Less(t, time.Since(start), 2*budget)
+		},
+		"MessageQueue delivers built messages": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			builder := &sliceBuilder[MessageType]{}
+			opts := Opts
+			mq := messagequeue.New[MessageType, MessageType](ctx, h.Peer, h.Network, builder, &opts, nil, nil)
+			mq.Startup()
+			t.Cleanup(mq.Shutdown)
+			messages := []MessageType{h.NewMessage(), h.NewMessage(), h.NewMessage()}
+			for _, message := range messages {
+				mq.BuildMessage(message)
+			}
+			received := make([]MessageType, 0, len(messages))
+			for range messages {
+				select {
+				case <-ctx.Done():
+					t.Fatal("message built in queue was not delivered")
+				case message := <-h.Received:
+					received = append(received, message)
+				}
+			}
+			require.ElementsMatch(t, messages, received)
+			require.Equal(t, len(messages), builder.sentCount())
+		},
+		"MessageQueue reports send timeout to stalled peer": func(ctx context.Context, t *testing.T, h Harness[MessageType]) {
+			if h.StalledPeer == "" {
+				t.Skip("network cannot simulate a stalled peer")
+			}
+			builder := &sliceBuilder[MessageType]{}
+			opts := Opts
+			mq := messagequeue.New[MessageType, MessageType](ctx, h.StalledPeer, h.Network, builder, &opts, nil, nil)
+			mq.Startup()
+			t.Cleanup(mq.Shutdown)
+			mq.BuildMessage(h.NewMessage())
+			budget := time.Duration(Opts.MaxRetries) * (Opts.SendTimeout + Opts.SendErrorBackoff)
+			require.Eventually(t, func() bool { return len(builder.errors()) > 0 }, 2*budget, 10*time.Millisecond)
+			require.ErrorIs(t, builder.errors()[0], network.ErrSendTimeout)
+			require.Zero(t, builder.sentCount())
+		},
+	}
+	for testCase, run := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			run(ctx, t, newHarness(t))
+		})
+	}
+}
+
+func newSender[MessageType network.Message[MessageType]](ctx context.Context, t *testing.T, h Harness[MessageType]) network.MessageSender[MessageType] {
+	t.Helper()
+	opts := Opts
+	sender, err := h.Network.NewMessageSender(ctx, h.Peer, &opts)
+	require.NoError(t, err)
+	return sender
+}
+
+func expectReceived[MessageType network.Message[MessageType]](ctx context.Context, t *testing.T, h Harness[MessageType], expected MessageType) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+		t.Fatal("message was not delivered")
+	case received := <-h.Received:
+		require.Equal(t, expected, received)
+	}
+}
+
+// sliceBuilder is a MessageBuilder that sends each built message as is
+type sliceBuilder[MessageType network.Message[MessageType]] struct {
+	lk      sync.Mutex
+	pending []MessageType
+	sent    int
+	errs    []error
+}
+
+func (sb *sliceBuilder[MessageType]) BuildMessage(message MessageType) bool {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	sb.pending = append(sb.pending, message)
+	return true
+}
+
+func (sb *sliceBuilder[MessageType]) NextMessage() (messagequeue.MessageSpec[MessageType], bool, error) {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	if len(sb.pending) == 0 {
+		return nil, false, messagequeue.ErrEmptyMessage
+	}
+	message := sb.pending[0]
+	sb.pending = sb.pending[1:]
+	return func() (MessageType, messagequeue.Notifier, error) {
+		return message, (*sentNotifier[MessageType])(sb), nil
+	}, len(sb.pending) > 0, nil
+}
+
+func (sb *sliceBuilder[MessageType]) sentCount() int {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	return sb.sent
+}
+
+func (sb *sliceBuilder[MessageType]) errors() []error {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	return append([]error(nil), sb.errs...)
+}
+
+type sentNotifier[MessageType network.Message[MessageType]] sliceBuilder[MessageType]
+
+func (sn *sentNotifier[MessageType]) HandleQueued()   {}
+func (sn *sentNotifier[MessageType]) HandleFinished() {}
+func (sn *sentNotifier[MessageType]) HandleError(err error) {
+	sn.lk.Lock()
+	defer sn.lk.Unlock()
+	sn.errs = append(sn.errs, err)
+}
+func (sn *sentNotifier[MessageType]) HandleSent() {
+	sn.lk.Lock()
+	defer sn.lk.Unlock()
+	sn.sent++
+}
@@ -0,0 +1,91 @@
+package messagequeue
+
+import "sync/atomic"
+
+// State is a stage in the lifecycle of a MessageQueue
+type State int32
+
+const (
+	// StateNew is a queue that has not been started
+	StateNew State = iota
+	// StateIdle is a running queue waiting for messages to send
+	StateIdle
+	// StateSending is a running queue sending messages
+	StateSending
+	// StatePaused is a running queue that has been paused, and holds its
+	// messages until it is resumed
+	StatePaused
+	// StateDraining is a queue that is shutting down, failing any messages
+	// still pending with ErrShutdown
+	StateDraining
+	// StateClosed is a queue that has stopped
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateIdle:
+		return "idle"
+	case StateSending:
+		return "sending"
+	case StatePaused:
+		return "paused"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// transitions are the state changes a queue can make
+var transitions = map[State][]State{
+	StateNew:      {StateIdle},
+	StateIdle:     {StateSending, StatePaused, StateDraining, StateClosed},
+	StateSending:  {StateIdle},
+	StatePaused:   {StateIdle, StateDraining, StateClosed},
+	StateDraining: {StateClosed},
+}
+
+// StateChangeHook is called when a queue changes state
+type StateChangeHook func(from, to State)
+
+// State returns the queue's current state
+func (mq *MessageQueue[MessageType, BuildParams]) State() State {
+	return State(atomic.LoadInt32((*int32)(&mq.state)))
+}
+
+// OnStateChange sets a hook called, on the queue's goroutine, each time the
+// queue changes state. It must be set before Startup.
+func (mq *MessageQueue[MessageType, BuildParams]) OnStateChange(hook StateChangeHook) {
+	mq.onStateChange = hook
+}
+
+// transition moves the queue to a new state. Transitions not in the state
+// machine are logged and ignored.
+func (mq *MessageQueue[MessageType, BuildParams]) transition(to State) {
+	from := mq.State()
+	if from == to {
+		return
+	}
+	if !canTransition(from, to) {
+		log.Errorf("message queue to %s: invalid state transition %s -> %s", mq.p, from, to)
+		return
+	}
+	atomic.StoreInt32((*int32)(&mq.state), int32(to))
+	if mq.onStateChange != nil {
+		mq.onStateChange(from, to)
+	}
+}
+
+func canTransition(from, to State) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
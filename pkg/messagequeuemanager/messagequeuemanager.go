@@ -44,3 +44,12 @@ func (pmm *MessageQueueManager[BuildParams]) BuildMessage(p peer.ID, messagePara
 	pq := pmm.GetHandler(p)
 	pq.BuildMessage(messageParams)
 }
+
+// BuildMessageEverywhere modifies the next message for every peer that
+// currently has a queue, e.g. to remove some pending data from all of them at
+// once. It does not create queues for other peers.
+func (pmm *MessageQueueManager[BuildParams]) BuildMessageEverywhere(messageParams BuildParams) {
+	pmm.EachHandler(func(_ peer.ID, mq MessageQueue[BuildParams]) {
+		mq.BuildMessage(messageParams)
+	})
+}
@@ -114,3 +114,33 @@ func TestSendingMessagesToPeers(t *testing.T) {
 	testutil.AssertContainsPeer(t, connectedPeers, tp[0])
 	testutil.AssertContainsPeer(t, connectedPeers, tp[1])
 }
+
+func TestBuildMessageEverywhere(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	messagesSent := make(chan messageSent, 5)
+	peerQueueFactory := makePeerQueueFactory(messagesSent)
+
+	tp := testutil.GeneratePeers(3)
+
+	peerManager := messagequeuemanager.NewMessageQueueManager(ctx, peerQueueFactory)
+	peerManager.Connected(tp[0])
+	peerManager.Connected(tp[1])
+
+	id := testutil.RandomBytes(100)
+	peerManager.BuildMessageEverywhere(func(b *testutil.SingleBuilder) {
+		b.SetID(id)
+	})
+
+	var sentTo []peer.ID
+	for i := 0; i < 2; i++ {
+		var message messageSent
+		testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+		require.Equal(t, &testutil.Message{Id: id}, message.message)
+		sentTo = append(sentTo, message.p)
+	}
+	require.ElementsMatch(t, []peer.ID{tp[0], tp[1]}, sentTo)
+	testutil.AssertChannelEmpty(t, messagesSent, "should only build into existing queues")
+	testutil.RefuteContainsPeer(t, peerManager.ConnectedPeers(), tp[2])
+}
@@ -0,0 +1,208 @@
+package messagequeuemanager_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	delay "github.com/ipfs/go-ipfs-delay"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeuemanager"
+	"github.com/ipfs/go-protocolnetwork/pkg/network"
+	"github.com/ipfs/go-protocolnetwork/pkg/testnet"
+)
+
+// TestSoak continuously sends messages between simulated peers while queues
+// are torn down at random, then checks that every message queued for sending
+// was finished, every message sent was delivered exactly once, and no
+// goroutines were leaked.
+func TestSoak(t *testing.T) {
+	duration := testutil.Soak(t)
+	const peerCount = 5
+
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	net := testnet.VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+	tracker := &soakTracker{messages: make(map[string]*soakMessage)}
+	peers := make([]peer.ID, 0, peerCount)
+	managers := make([]*messagequeuemanager.MessageQueueManager[[]byte], 0, peerCount)
+	opts := &network.MessageSenderOpts{MaxRetries: 3, SendTimeout: time.Second, SendErrorBackoff: 10 * time.Millisecond}
+	for i := 0; i < peerCount; i++ {
+		identity := tnet.RandIdentityOrFatal(t)
+		adapter := net.Adapter(identity)
+		adapter.Start(&soakReceiver{tracker})
+		peers = append(peers, identity.ID())
+		managers = append(managers, messagequeuemanager.NewMessageQueueManager(ctx, func(ctx context.Context, p peer.ID, onShutdown func(peer.ID)) messagequeuemanager.MessageQueue[[]byte] {
+			return messagequeue.New[*testutil.Message, []byte](ctx, p, adapter, &soakBuilder{tracker: tracker}, opts, nil, func() { onShutdown(p) })
+		}))
+	}
+
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		from, to := rand.Intn(peerCount), rand.Intn(peerCount)
+		if from == to {
+			continue
+		}
+		if rand.Intn(100) == 0 {
+			// churn: tear down the queue, dropping or failing what's pending
+			managers[from].Disconnected(peers[to])
+			continue
+		}
+		managers[from].BuildMessage(peers[to], tracker.newMessage())
+		if rand.Intn(10) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for _, manager := range managers {
+		for _, p := range manager.ConnectedPeers() {
+			manager.Disconnected(p)
+		}
+	}
+
+	if !assertEventually(func() bool { return tracker.settled() }) {
+		t.Fatalf("messages did not settle:\n%s", tracker.diagnostics())
+	}
+	cancel()
+	if !assertEventually(func() bool { return runtime.NumGoroutine() <= baseline }) {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("goroutines leaked: %d running, %d at start\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+	}
+	t.Log(tracker.diagnostics())
+}
+
+func assertEventually(condition func() bool) bool {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+type soakMessage struct {
+	queued, errored, sent, finished, delivered int
+}
+
+// settled checks a message was finished at most once, and only after being
+// queued, and that it was delivered once if and only if it was sent
+func (m *soakMessage) settled() bool {
+	return m.finished <= 1 && m.delivered <= 1 && m.delivered == m.sent && (m.queued == 0 || m.finished == 1)
+}
+
+type soakTracker struct {
+	lk       sync.Mutex
+	messages map[string]*soakMessage
+}
+
+func (st *soakTracker) newMessage() []byte {
+	id := testutil.RandomBytes(16)
+	st.lk.Lock()
+	st.messages[string(id)] = &soakMessage{}
+	st.lk.Unlock()
+	return id
+}
+
+func (st *soakTracker) update(id []byte, update func(*soakMessage)) {
+	st.lk.Lock()
+	update(st.messages[string(id)])
+	st.lk.Unlock()
+}
+
+func (st *soakTracker) settled() bool {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	for _, m := range st.messages {
+		if !m.settled() {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *soakTracker) diagnostics() string {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	var queued, sent, errored, delivered, violations int
+	for _, m := range st.messages {
+		queued += m.queued
+		sent += m.sent
+		errored += m.errored
+		delivered += m.delivered
+		if !m.settled() {
+			violations++
+		}
+	}
+	return fmt.Sprintf("built: %d, queued: %d, sent: %d, errored: %d, delivered: %d, violations: %d",
+		len(st.messages), queued, sent, errored, delivered, violations)
+}
+
+// soakBuilder queues each message built rather than merging them, so every
+// message can be accounted for
+type soakBuilder struct {
+	tracker *soakTracker
+	lk      sync.Mutex
+	pending [][]byte
+}
+
+func (sb *soakBuilder) BuildMessage(id []byte) bool {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	sb.pending = append(sb.pending, id)
+	return true
+}
+
+func (sb *soakBuilder) NextMessage() (messagequeue.MessageSpec[*testutil.Message], bool, error) {
+	sb.lk.Lock()
+	defer sb.lk.Unlock()
+	if len(sb.pending) == 0 {
+		return nil, false, messagequeue.ErrEmptyMessage
+	}
+	id := sb.pending[0]
+	sb.pending = sb.pending[1:]
+	return func() (*testutil.Message, messagequeue.Notifier, error) {
+		return &testutil.Message{Id: id}, &soakNotifier{sb.tracker, id}, nil
+	}, len(sb.pending) > 0, nil
+}
+
+type soakNotifier struct {
+	tracker *soakTracker
+	id      []byte
+}
+
+func (sn *soakNotifier) HandleQueued() {
+	sn.tracker.update(sn.id, func(m *soakMessage) { m.queued++ })
+}
+
+func (sn *soakNotifier) HandleError(error) {
+	sn.tracker.update(sn.id, func(m *soakMessage) { m.errored++ })
+}
+
+func (sn *soakNotifier) HandleSent() {
+	sn.tracker.update(sn.id, func(m *soakMessage) { m.sent++ })
+}
+
+func (sn *soakNotifier) HandleFinished() {
+	sn.tracker.update(sn.id, func(m *soakMessage) { m.finished++ })
+}
+
+type soakReceiver struct {
+	tracker *soakTracker
+}
+
+func (sr *soakReceiver) ReceiveMessage(_ context.Context, _ peer.ID, incoming *testutil.Message) {
+	sr.tracker.update(incoming.Id, func(m *soakMessage) { m.delivered++ })
+}
+
+func (sr *soakReceiver) ReceiveError(peer.ID, error) {}
+func (sr *soakReceiver) PeerConnected(peer.ID)       {}
+func (sr *soakReceiver) PeerDisconnected(peer.ID)    {}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// minBufferClass is the smallest pooled buffer size, 64 bytes
+	minBufferClass = 6
+	// maxBufferClass is the largest pooled buffer size, 4MiB, matching the
+	// libp2p message size limit. Larger buffers are allocated unpooled.
+	maxBufferClass = 22
+)
+
+// buffers is the pool outgoing messages are staged in when they are
+// transformed
+var buffers = &bufferPool{}
+
+// bufferPool pools byte slices in power of two size classes, so a buffer is
+// only reused for messages of a similar size. Gets served from the pool are
+// counted as buffer_pool_hits, and gets that allocate as buffer_pool_misses.
+type bufferPool struct {
+	classes [maxBufferClass - minBufferClass + 1]sync.Pool
+}
+
+// get returns a slice of the given length, with the capacity of its size
+// class
+func (bp *bufferPool) get(size int) []byte {
+	class := sizeClass(size)
+	if class > maxBufferClass {
+		metrics.Add("buffer_pool_misses", 1)
+		return make([]byte, size)
+	}
+	if buf, ok := bp.classes[class-minBufferClass].Get().(*[]byte); ok {
+		metrics.Add("buffer_pool_hits", 1)
+		return (*buf)[:size]
+	}
+	metrics.Add("buffer_pool_misses", 1)
+	return make([]byte, size, 1<<class)
+}
+
+// put returns a slice from get to the pool. Slices that didn't come from the
+// pool are dropped.
+func (bp *bufferPool) put(buf []byte) {
+	class := sizeClass(cap(buf))
+	if cap(buf) != 1<<class || class > maxBufferClass {
+		return
+	}
+	buf = buf[:0]
+	bp.classes[class-minBufferClass].Put(&buf)
+}
+
+func sizeClass(size int) int {
+	if size <= 1<<minBufferClass {
+		return minBufferClass
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// bufferWriter is an io.Writer that grows its buffer from a bufferPool
+type bufferWriter struct {
+	pool *bufferPool
+	buf  []byte
+}
+
+func (bw *bufferWriter) Write(p []byte) (int, error) {
+	if len(bw.buf)+len(p) > cap(bw.buf) {
+		grown := bw.pool.get(len(bw.buf) + len(p))
+		copy(grown, bw.buf)
+		bw.pool.put(bw.buf)
+		bw.buf = grown[:len(bw.buf)]
+	}
+	bw.buf = append(bw.buf, p...)
+	return len(p), nil
+}
+
+// release returns the writer's buffer to the pool
+func (bw *bufferWriter) release() {
+	bw.pool.put(bw.buf)
+	bw.buf = nil
+}
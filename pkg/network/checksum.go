@@ -0,0 +1,60 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ErrChecksumMismatch is returned when a message read from a peer does not
+// match its frame checksum, e.g. because it was truncated or corrupted
+var ErrChecksumMismatch = errors.New("frame checksum mismatch")
+
+const checksumSize = crc32.Size
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FrameChecksums returns a pair of transforms that frame each message
+// exchanged over the given protocols with a CRC-32C checksum. The outgoing
+// transform appends the checksum, and the incoming transform verifies and
+// strips it, failing with ErrChecksumMismatch. Messages over other protocols
+// are passed through unchanged.
+//
+// Both peers must checksum the same protocols, so checksums are best
+// introduced with a new protocol version:
+//
+//	outgoing, incoming := network.FrameChecksums(protocolV3)
+//	selector = network.NewTransformingSelector(selector,
+//		network.OutgoingTransform(outgoing), network.IncomingTransform(incoming))
+func FrameChecksums(protocols ...protocol.ID) (outgoing Transform, incoming Transform) {
+	checksummed := make(map[protocol.ID]struct{}, len(protocols))
+	for _, proto := range protocols {
+		checksummed[proto] = struct{}{}
+	}
+	outgoing = func(_ peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+		if _, ok := checksummed[proto]; !ok {
+			return data, nil
+		}
+		framed := make([]byte, len(data)+checksumSize)
+		copy(framed, data)
+		binary.BigEndian.PutUint32(framed[len(data):], crc32.Checksum(data, checksumTable))
+		return framed, nil
+	}
+	incoming = func(_ peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+		if _, ok := checksummed[proto]; !ok {
+			return data, nil
+		}
+		if len(data) < checksumSize {
+			return nil, ErrChecksumMismatch
+		}
+		payload := data[:len(data)-checksumSize]
+		if binary.BigEndian.Uint32(data[len(payload):]) != crc32.Checksum(payload, checksumTable) {
+			return nil, ErrChecksumMismatch
+		}
+		return payload, nil
+	}
+	return outgoing, incoming
+}
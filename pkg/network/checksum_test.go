@@ -0,0 +1,53 @@
+package network_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
+)
+
+func TestFrameChecksums(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	msg := &testutil.Message{
+		Id:      testutil.RandomBytes(100),
+		Payload: testutil.RandomBytes(100),
+	}
+	selector := &MessageHandlerSelector{}
+	outgoing, incoming := pn.FrameChecksums(testutil.ProtocolMockV2)
+	ts := pn.NewTransformingSelector[*testutil.Message](selector, pn.OutgoingTransform(outgoing), pn.IncomingTransform(incoming))
+
+	testCases := map[string]func(t *testing.T){
+		"round trip": func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, ts.Select(testutil.ProtocolMockV2).ToNet(p, msg, buf))
+			received, err := ts.Select(testutil.ProtocolMockV2).FromNet(p, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, received)
+		},
+		"corrupted frame": func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, ts.Select(testutil.ProtocolMockV2).ToNet(p, msg, buf))
+			corrupted := buf.Bytes()
+			corrupted[len(corrupted)/2] ^= 0xff
+			_, err := ts.Select(testutil.ProtocolMockV2).FromNet(p, bytes.NewReader(corrupted))
+			require.ErrorIs(t, err, pn.ErrChecksumMismatch)
+		},
+		"unchecksummed protocol": func(t *testing.T) {
+			plain := new(bytes.Buffer)
+			require.NoError(t, selector.Select(testutil.ProtocolMockV1).ToNet(p, msg, plain))
+			buf := new(bytes.Buffer)
+			require.NoError(t, ts.Select(testutil.ProtocolMockV1).ToNet(p, msg, buf))
+			require.Equal(t, plain.Bytes(), buf.Bytes())
+			received, err := ts.Select(testutil.ProtocolMockV1).FromNet(p, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, received)
+		},
+	}
+	for testCase, run := range testCases {
+		t.Run(testCase, run)
+	}
+}
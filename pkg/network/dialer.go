@@ -0,0 +1,155 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrDialBackoff is returned when connecting to a peer that recently failed
+// to connect, until its dial backoff expires
+var ErrDialBackoff = errors.New("dial backoff")
+
+// dialManager limits the dials in progress across all peers, coalesces
+// concurrent dials to the same peer, and remembers failed dials so a burst of
+// sends to an offline peer doesn't redial it each time
+type dialManager struct {
+	dial    func(context.Context, peer.ID) error
+	slots   chan struct{}
+	backoff time.Duration
+	// onBackoff, if set, is called when a peer enters dial backoff
+	onBackoff func(p peer.ID, until time.Time, err error)
+
+	lk       sync.Mutex
+	inflight map[peer.ID]*pendingDial
+	failures map[peer.ID]dialFailure
+}
+
+type pendingDial struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type dialFailure struct {
+	err   error
+	until time.Time
+}
+
+// newDialManager creates a dialManager running at most maxConcurrent dials at
+// once, or any number if maxConcurrent is 0. Failed peers are not redialed
+// for the backoff duration.
+func newDialManager(dial func(context.Context, peer.ID) error, maxConcurrent int, backoff time.Duration) *dialManager {
+	dm := &dialManager{
+		dial:     dial,
+		backoff:  backoff,
+		inflight: make(map[peer.ID]*pendingDial),
+		failures: make(map[peer.ID]dialFailure),
+	}
+	if maxConcurrent > 0 {
+		dm.slots = make(chan struct{}, maxConcurrent)
+	}
+	return dm
+}
+
+// connect dials the peer, or joins a dial already in progress to it. The dial
+// is shared by every caller, so it runs independently of any one caller's
+// context, up to network.DialPeerTimeout; each caller stops waiting when its
+// own context is done, and the dial is cancelled once no caller is waiting.
+func (dm *dialManager) connect(ctx context.Context, p peer.ID) error {
+	dm.lk.Lock()
+	if failure, ok := dm.failures[p]; ok {
+		if time.Now().Before(failure.until) {
+			dm.lk.Unlock()
+			return fmt.Errorf("%w for %s after: %s", ErrDialBackoff, p, failure.err)
+		}
+		delete(dm.failures, p)
+	}
+	pending, ok := dm.inflight[p]
+	if !ok {
+		dialCtx, cancel := context.WithTimeout(context.Background(), network.DialPeerTimeout)
+		pending = &pendingDial{done: make(chan struct{}), cancel: cancel}
+		dm.inflight[p] = pending
+		go dm.run(dialCtx, p, pending)
+	}
+	pending.waiters++
+	dm.lk.Unlock()
+
+	select {
+	case <-pending.done:
+		return pending.err
+	case <-ctx.Done():
+		dm.lk.Lock()
+		pending.waiters--
+		if pending.waiters == 0 {
+			// later callers start a fresh dial rather than joining this one
+			pending.cancel()
+			dm.forget(p, pending)
+		}
+		dm.lk.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (dm *dialManager) run(ctx context.Context, p peer.ID, pending *pendingDial) {
+	defer pending.cancel()
+	err := dm.dialWithSlot(ctx, p)
+
+	var until time.Time
+	dm.lk.Lock()
+	dm.forget(p, pending)
+	// a dial that was abandoned or ran out of time says nothing about the peer
+	if err != nil && dm.backoff > 0 && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		now := time.Now()
+		dm.pruneFailures(now)
+		until = now.Add(dm.backoff)
+		dm.failures[p] = dialFailure{err: err, until: until}
+	}
+	pending.err = err
+	dm.lk.Unlock()
+	close(pending.done)
+	if !until.IsZero() && dm.onBackoff != nil {
+		dm.onBackoff(p, until, err)
+	}
+}
+
+func (dm *dialManager) forget(p peer.ID, pending *pendingDial) {
+	if dm.inflight[p] == pending {
+		delete(dm.inflight, p)
+	}
+}
+
+func (dm *dialManager) dialWithSlot(ctx context.Context, p peer.ID) error {
+	if dm.slots != nil {
+		select {
+		case dm.slots <- struct{}{}:
+			defer func() { <-dm.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return dm.dial(ctx, p)
+}
+
+// pruneFailures forgets failures whose backoff has expired, so peers that are
+// never dialed again aren't remembered forever
+func (dm *dialManager) pruneFailures(now time.Time) {
+	for p, failure := range dm.failures {
+		if !now.Before(failure.until) {
+			delete(dm.failures, p)
+		}
+	}
+}
+
+// connected clears any backoff for a peer that has connected
+func (dm *dialManager) connected(p peer.ID) {
+	dm.lk.Lock()
+	delete(dm.failures, p)
+	dm.lk.Unlock()
+}
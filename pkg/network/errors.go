@@ -0,0 +1,77 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+var (
+	// ErrSendTimeout is wrapped by errors from sending a message that did not
+	// complete before its deadline
+	ErrSendTimeout = errors.New("timed out sending message")
+	// ErrRetriesExhausted is matched by a SendError, returned once every
+	// attempt to reach a peer has failed
+	ErrRetriesExhausted = errors.New("retries exhausted")
+	// ErrPeerDisconnected is wrapped by the error from a send that was aborted
+	// because the peer disconnected
+	ErrPeerDisconnected = errors.New("peer disconnected")
+	// ErrNotConnected is returned by a MessageSender whose ConnectPolicy does
+	// not allow dialing a peer that is not connected
+	ErrNotConnected = errors.New("peer not connected")
+	// ErrPeerGreylisted is wrapped by the error from sending to a peer on the
+	// network's greylist
+	ErrPeerGreylisted = errors.New("peer greylisted")
+	// ErrMessageTooLarge is returned when reading a message larger than the
+	// maximum message size
+	ErrMessageTooLarge = msgio.ErrMsgTooLarge
+)
+
+// SendError is returned by a MessageSender when every attempt to reach a peer
+// has failed. It matches ErrRetriesExhausted, and unwraps to the error from the
+// final attempt.
+type SendError struct {
+	Peer     peer.ID
+	Attempts int
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("failed to send to %s after %d attempts: %s", e.Peer, e.Attempts, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SendError) Is(target error) bool {
+	return target == ErrRetriesExhausted
+}
+
+// classifySendError wraps a timeout error so it matches ErrSendTimeout
+func classifySendError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return timeoutError{err}
+	}
+	return err
+}
+
+type timeoutError struct {
+	err error
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSendTimeout, e.err)
+}
+
+func (e timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e timeoutError) Is(target error) bool {
+	return target == ErrSendTimeout
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EvtSendFailed is emitted on the host's event bus, when PublishEvents is
+// set, after every attempt to send a message to a peer has failed.
+type EvtSendFailed struct {
+	// ProtocolName is the name the network was created with
+	ProtocolName string
+	Peer         peer.ID
+	Err          error
+}
+
+// EvtPeerGreylisted is emitted on the host's event bus, when PublishEvents is
+// set, when a peer is greylisted after repeated protocol violations.
+type EvtPeerGreylisted struct {
+	// ProtocolName is the name the network was created with
+	ProtocolName string
+	Peer         peer.ID
+}
+
+// EvtPeerThrottled is emitted on the host's event bus, when PublishEvents is
+// set, when a failed dial puts a peer in dial backoff. Until then, connecting
+// to the peer fails with ErrDialBackoff.
+type EvtPeerThrottled struct {
+	// ProtocolName is the name the network was created with
+	ProtocolName string
+	Peer         peer.ID
+	Until        time.Time
+	// Err is the error the dial failed with
+	Err error
+}
+
+// eventEmitters publishes network events on a libp2p event bus. Emitters are
+// opened when the network starts and closed when it stops.
+type eventEmitters struct {
+	bus event.Bus
+
+	lk         sync.RWMutex
+	sendFailed event.Emitter
+	greylisted event.Emitter
+	throttled  event.Emitter
+}
+
+func newEventEmitters(bus event.Bus) *eventEmitters {
+	return &eventEmitters{bus: bus}
+}
+
+// open is a no-op if events are not being published or are already open
+func (ee *eventEmitters) open() error {
+	if ee == nil {
+		return nil
+	}
+	ee.lk.Lock()
+	defer ee.lk.Unlock()
+	if ee.sendFailed != nil {
+		return nil
+	}
+	sendFailed, err := ee.bus.Emitter(new(EvtSendFailed))
+	if err != nil {
+		return err
+	}
+	greylisted, err := ee.bus.Emitter(new(EvtPeerGreylisted))
+	if err != nil {
+		_ = sendFailed.Close()
+		return err
+	}
+	throttled, err := ee.bus.Emitter(new(EvtPeerThrottled))
+	if err != nil {
+		_ = sendFailed.Close()
+		_ = greylisted.Close()
+		return err
+	}
+	ee.sendFailed, ee.greylisted, ee.throttled = sendFailed, greylisted, throttled
+	return nil
+}
+
+// close is a no-op if events are not being published or are not open
+func (ee *eventEmitters) close() {
+	if ee == nil {
+		return
+	}
+	ee.lk.Lock()
+	defer ee.lk.Unlock()
+	if ee.sendFailed == nil {
+		return
+	}
+	_ = ee.sendFailed.Close()
+	_ = ee.greylisted.Close()
+	_ = ee.throttled.Close()
+	ee.sendFailed, ee.greylisted, ee.throttled = nil, nil, nil
+}
+
+// emit publishes evt on the emitter picked from ee, if events are open. Emit
+// blocks until subscribers take the event, so the emitter is copied out
+// rather than held under the lock, which would stall close and every other
+// emit. Emitting on an emitter closed in the meantime just fails.
+func (ee *eventEmitters) emit(pick func(*eventEmitters) event.Emitter, evt interface{}) {
+	if ee == nil {
+		return
+	}
+	ee.lk.RLock()
+	emitter := pick(ee)
+	ee.lk.RUnlock()
+	if emitter != nil {
+		_ = emitter.Emit(evt)
+	}
+}
+
+// emitSendFailed is a no-op if events are not being published
+func (ee *eventEmitters) emitSendFailed(evt EvtSendFailed) {
+	ee.emit(func(ee *eventEmitters) event.Emitter { return ee.sendFailed }, evt)
+}
+
+// emitGreylisted is a no-op if events are not being published
+func (ee *eventEmitters) emitGreylisted(evt EvtPeerGreylisted) {
+	ee.emit(func(ee *eventEmitters) event.Emitter { return ee.greylisted }, evt)
+}
+
+// emitThrottled is a no-op if events are not being published
+func (ee *eventEmitters) emitThrottled(evt EvtPeerThrottled) {
+	ee.emit(func(ee *eventEmitters) event.Emitter { return ee.throttled }, evt)
+}
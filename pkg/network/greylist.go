@@ -0,0 +1,163 @@
+package network
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Greylist tracks protocol violations (e.g. malformed messages) per peer and
+// temporarily greylists peers whose violations accumulate. Each peer's
+// violation score decays exponentially over time, so occasional errors are
+// forgiven while persistent offenders are cut off. Peers can be explicitly
+// allowed or denied, overriding their score.
+type Greylist struct {
+	lk        sync.Mutex
+	peers     map[peer.ID]*violations
+	overrides map[peer.ID]bool
+
+	threshold  float64
+	halfLife   time.Duration
+	duration   time.Duration
+	lastPruned time.Time
+}
+
+// scoreTolerance is how close a score must be to a threshold to count as
+// reaching it, so that decay between violations in quick succession doesn't
+// matter, and below which a peer's history is forgotten
+const scoreTolerance = 0.01
+
+// maxPruneInterval is the longest recording violations goes without also
+// forgetting peers whose history has decayed away, so peers that are never
+// looked up again don't stay tracked forever. Shorter half lives prune once
+// per half life.
+const maxPruneInterval = time.Minute
+
+type violations struct {
+	score           float64
+	lastUpdated     time.Time
+	greylistedUntil time.Time
+}
+
+// NewGreylist returns a Greylist that greylists a peer for duration once its
+// violation score reaches threshold. Each violation adds one to the score, and
+// the score halves every halfLife.
+func NewGreylist(threshold float64, halfLife time.Duration, duration time.Duration) *Greylist {
+	return &Greylist{
+		peers:     make(map[peer.ID]*violations),
+		overrides: make(map[peer.ID]bool),
+		threshold: threshold,
+		halfLife:  halfLife,
+		duration:  duration,
+	}
+}
+
+// RecordViolation records a protocol violation by the given peer, and returns
+// true if the peer became greylisted as a result
+func (g *Greylist) RecordViolation(p peer.ID) bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	now := time.Now()
+	pruneInterval := maxPruneInterval
+	if g.halfLife > 0 && g.halfLife < pruneInterval {
+		pruneInterval = g.halfLife
+	}
+	if now.Sub(g.lastPruned) >= pruneInterval {
+		g.prune(now)
+	}
+	v, ok := g.peers[p]
+	if !ok {
+		v = &violations{lastUpdated: now}
+		g.peers[p] = v
+	}
+	g.decay(v, now)
+	v.score++
+	if v.score+scoreTolerance < g.threshold || now.Before(v.greylistedUntil) {
+		return false
+	}
+	v.score = 0
+	v.greylistedUntil = now.Add(g.duration)
+	return !g.overridden(p)
+}
+
+// IsGreylisted returns true if the peer is currently greylisted, either
+// because of its violations or because it was explicitly denied
+func (g *Greylist) IsGreylisted(p peer.ID) bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+
+	if allowed, ok := g.overrides[p]; ok {
+		return !allowed
+	}
+	v, ok := g.peers[p]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	g.decay(v, now)
+	if now.Before(v.greylistedUntil) {
+		return true
+	}
+	if v.score < scoreTolerance {
+		delete(g.peers, p)
+	}
+	return false
+}
+
+// prune forgets every peer that is not greylisted and whose score has decayed
+// away
+func (g *Greylist) prune(now time.Time) {
+	g.lastPruned = now
+	for p, v := range g.peers {
+		g.decay(v, now)
+		if v.score < scoreTolerance && !now.Before(v.greylistedUntil) {
+			delete(g.peers, p)
+		}
+	}
+}
+
+// Len returns the number of peers with a violation history
+func (g *Greylist) Len() int {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return len(g.peers)
+}
+
+// Allow overrides the greylist so the peer is never greylisted
+func (g *Greylist) Allow(p peer.ID) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	g.overrides[p] = true
+}
+
+// Deny overrides the greylist so the peer is always greylisted
+func (g *Greylist) Deny(p peer.ID) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	g.overrides[p] = false
+}
+
+// ClearOverride removes any Allow or Deny override for the peer, and resets
+// its violation history
+func (g *Greylist) ClearOverride(p peer.ID) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	delete(g.overrides, p)
+	delete(g.peers, p)
+}
+
+func (g *Greylist) overridden(p peer.ID) bool {
+	_, ok := g.overrides[p]
+	return ok
+}
+
+func (g *Greylist) decay(v *violations, now time.Time) {
+	if g.halfLife > 0 {
+		elapsed := now.Sub(v.lastUpdated)
+		v.score *= math.Pow(0.5, float64(elapsed)/float64(g.halfLife))
+	}
+	v.lastUpdated = now
+}
@@ -0,0 +1,98 @@
+package network_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
+)
+
+func TestGreylist(t *testing.T) {
+	t.Run("greylists after threshold, for duration", func(t *testing.T) {
+		p := testutil.GeneratePeers(1)[0]
+		greylist := pn.NewGreylist(2, time.Hour, 50*time.Millisecond)
+		require.False(t, greylist.RecordViolation(p))
+		require.False(t, greylist.IsGreylisted(p))
+		require.True(t, greylist.RecordViolation(p))
+		require.True(t, greylist.IsGreylisted(p))
+		time.Sleep(60 * time.Millisecond)
+		require.False(t, greylist.IsGreylisted(p))
+	})
+
+	t.Run("violations decay", func(t *testing.T) {
+		p := testutil.GeneratePeers(1)[0]
+		greylist := pn.NewGreylist(2, 10*time.Millisecond, time.Hour)
+		require.False(t, greylist.RecordViolation(p))
+		time.Sleep(50 * time.Millisecond)
+		require.False(t, greylist.RecordViolation(p))
+		require.False(t, greylist.IsGreylisted(p))
+	})
+
+	t.Run("forgets decayed peers", func(t *testing.T) {
+		tp := testutil.GeneratePeers(3)
+		greylist := pn.NewGreylist(2, 10*time.Millisecond, time.Hour)
+		require.False(t, greylist.RecordViolation(tp[0]))
+		require.False(t, greylist.RecordViolation(tp[1]))
+		require.Equal(t, 2, greylist.Len())
+		time.Sleep(100 * time.Millisecond)
+		require.False(t, greylist.RecordViolation(tp[2]))
+		require.Equal(t, 1, greylist.Len())
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		tp := testutil.GeneratePeers(2)
+		allowed, denied := tp[0], tp[1]
+		greylist := pn.NewGreylist(1, time.Hour, time.Hour)
+		greylist.Allow(allowed)
+		greylist.Deny(denied)
+		require.False(t, greylist.RecordViolation(allowed))
+		require.False(t, greylist.IsGreylisted(allowed))
+		require.True(t, greylist.IsGreylisted(denied))
+
+		greylist.ClearOverride(allowed)
+		greylist.ClearOverride(denied)
+		require.False(t, greylist.IsGreylisted(allowed))
+		require.False(t, greylist.IsGreylisted(denied))
+		require.True(t, greylist.RecordViolation(allowed))
+		require.True(t, greylist.IsGreylisted(allowed))
+	})
+}
+
+func TestGreylistedPeerIsRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	pn1 := newNetwork(mn, p1)
+	h2, err := mn.AddPeer(p2.PrivateKey(), p2.Address())
+	require.NoError(t, err)
+	greylist := pn.NewGreylist(1, time.Hour, time.Hour)
+	pn2 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h2, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.GreylistPeers(greylist))
+	r1 := newReceiver()
+	r2 := newReceiver()
+	pn1.Start(r1)
+	t.Cleanup(pn1.Stop)
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, pn1.ConnectTo(ctx, p2.ID()))
+
+	msg := &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+	require.NoError(t, pn1.SendMessage(ctx, p2.ID(), msg))
+	testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "message from peer that is not greylisted was not received")
+
+	greylist.Deny(p1.ID())
+	_ = pn1.SendMessage(ctx, p2.ID(), msg)
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer timeoutCancel()
+	testutil.AssertDoesReceiveFirst(t, timeoutCtx.Done(), "message from greylisted peer should not be received", r2.messageReceived)
+}
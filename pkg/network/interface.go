@@ -3,6 +3,7 @@ package network
 import (
 	"context"
 	"io"
+	"net"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -11,6 +12,8 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 
 	msgio "github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 type Message[MessageType any] interface {
@@ -75,8 +78,37 @@ type MessageSenderOpts struct {
 	MaxRetries       int
 	SendTimeout      time.Duration
 	SendErrorBackoff time.Duration
+	// StreamMessageLimit is the number of messages sent on a stream before it
+	// is closed and a new one opened for the next message. 1 opens a new stream
+	// per message. 0, the default, keeps a single long-lived stream.
+	StreamMessageLimit int
+	// StreamByteLimit is the number of bytes sent on a stream before it is
+	// closed and a new one opened for the next message. 0, the default, means
+	// no limit.
+	StreamByteLimit int64
+	// ConnectPolicy is what the sender does when the peer is not connected
+	ConnectPolicy ConnectPolicy
 }
 
+// ConnectPolicy determines how a MessageSender handles a peer that is not
+// connected
+type ConnectPolicy int
+
+const (
+	// DialOnDemand dials the peer, and is the default
+	DialOnDemand ConnectPolicy = iota
+	// WaitForConnection waits for the peer to connect, without dialing it.
+	// Each attempt to open a stream waits at most SendTimeout, and then fails
+	// with ErrNotConnected, without retrying. If the context passed to the
+	// sender is done first, the wait ends early with the context's error. A
+	// message queue does not hold messages for a peer that never connects:
+	// it fails the message being sent with ErrNotConnected and shuts down,
+	// failing any other pending messages with ErrShutdown.
+	WaitForConnection
+	// FailIfNotConnected fails immediately with ErrNotConnected
+	FailIfNotConnected
+)
+
 // Receiver is an interface that can receive messages from the BitSwapNetwork.
 type Receiver[MessageType Message[MessageType]] interface {
 	ReceiveMessage(
@@ -99,6 +131,41 @@ type Pinger interface {
 	Latency(peer.ID) time.Duration
 }
 
+// PeerInfo is the metadata the network layer has learned about a remote peer
+// (e.g. via the libp2p identify protocol)
+type PeerInfo struct {
+	// AgentVersion is the agent string the peer advertised, or "" if unknown
+	AgentVersion string
+	// Protocols are the protocols supported by this network that the peer has
+	// advertised support for, with any protocol prefix removed
+	Protocols []protocol.ID
+	// Addrs are the remote addresses of the open connections to the peer
+	Addrs []ma.Multiaddr
+}
+
+// IPs returns the IP addresses the peer is connected from, e.g. for applying
+// limits by IP or subnet in addition to peer ID. Addresses without an IP
+// component (such as relayed connections) are skipped.
+func (pi PeerInfo) IPs() []net.IP {
+	ips := make([]net.IP, 0, len(pi.Addrs))
+	for _, addr := range pi.Addrs {
+		ip, err := manet.ToIP(addr)
+		if err != nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// PeerInfoProvider exposes peer metadata to policy hooks, so they can, e.g.,
+// apply stricter limits to unknown agents or deny legacy protocol versions. It
+// is optionally implemented by a ProtocolNetwork, and implemented by networks
+// from NewFromLibp2pHost, so callers should check for it with a type assertion.
+type PeerInfoProvider interface {
+	PeerInfo(peer.ID) PeerInfo
+}
+
 // Stats is a container for statistics about the bitswap network
 // the numbers inside are specific to bitswap, and not any other protocols
 // using the same underlying network.
@@ -3,8 +3,12 @@ package network
 import (
 	"context"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"runtime/pprof"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,6 +26,9 @@ import (
 
 var connectTimeout = time.Second * 5
 
+// metrics are published via expvar, aggregated across all networks
+var metrics = expvar.NewMap("protocolnetwork.network")
+
 var maxSendTimeout = 2 * time.Minute
 var minSendTimeout = 10 * time.Second
 var sendLatency = 2 * time.Second
@@ -33,22 +40,46 @@ func NewFromLibp2pHost[MessageType Message[MessageType]](
 	host host.Host,
 	messageHandlerSelector MessageHandlerSelector[MessageType],
 	opts ...NetOpt) ProtocolNetwork[MessageType] {
-	s := Settings{}
+	s := Settings{MaxMessageSize: network.MessageSizeMax}
 	for _, opt := range opts {
 		opt(&s)
 	}
-	for i, proto := range s.SupportedProtocols {
-		s.SupportedProtocols[i] = s.ProtocolPrefix + proto
+	if limiter, ok := messageHandlerSelector.(messageSizeLimiter[MessageType]); ok {
+		messageHandlerSelector = limiter.withMaxMessageSize(s.MaxMessageSize)
+	}
+	// prefix a copy, so callers can share a list of protocols across networks
+	supportedProtocols := make([]protocol.ID, 0, len(s.SupportedProtocols))
+	for _, proto := range s.SupportedProtocols {
+		supportedProtocols = append(supportedProtocols, s.ProtocolPrefix+proto)
+	}
+	s.SupportedProtocols = supportedProtocols
+
+	log := logging.Logger("protocolnetwork/" + protocolName + "_network")
+	var emitters *eventEmitters
+	if s.PublishEvents {
+		emitters = newEventEmitters(host.EventBus())
 	}
 
-	return &libp2pProtocolNetwork[MessageType]{
-		log:                    logging.Logger("protocolnetwork/" + protocolName + "_network"),
+	pn := &libp2pProtocolNetwork[MessageType]{
+		log:                    log,
 		protocolName:           protocolName,
 		host:                   host,
 		protocolPrefix:         s.ProtocolPrefix,
 		supportedProtocols:     s.SupportedProtocols,
 		messageHandlerSelector: messageHandlerSelector,
+		greylist:               s.Greylist,
+		emitters:               emitters,
+		maxMessageSize:         s.MaxMessageSize,
+	}
+	pn.dialer = newDialManager(func(ctx context.Context, p peer.ID) error {
+		return host.Connect(ctx, peer.AddrInfo{ID: p})
+	}, s.MaxConcurrentDials, s.DialBackoff)
+	if emitters != nil {
+		pn.dialer.onBackoff = func(p peer.ID, until time.Time, err error) {
+			emitters.emitThrottled(EvtPeerThrottled{ProtocolName: protocolName, Peer: p, Until: until, Err: err})
+		}
 	}
+	return pn
 }
 
 // libp2pProtocolNetwork transforms the ipfs network interface, which sends and receives
@@ -66,6 +97,12 @@ type libp2pProtocolNetwork[MessageType Message[MessageType]] struct {
 	protocolPrefix protocol.ID
 
 	supportedProtocols []protocol.ID
+	greylist           *Greylist
+	emitters           *eventEmitters
+	maxMessageSize     int
+	dialer             *dialManager
+	sendAborts         sendAborts
+	connectWaiters     connectWaiters
 
 	messageHandlerSelector MessageHandlerSelector[MessageType]
 	// inbound messages from the network are forwarded to the receiver
@@ -73,16 +110,21 @@ type libp2pProtocolNetwork[MessageType Message[MessageType]] struct {
 }
 
 type streamMessageSender[MessageType Message[MessageType]] struct {
-	to        peer.ID
-	stream    network.Stream
-	connected bool
-	network   *libp2pProtocolNetwork[MessageType]
+	to             peer.ID
+	stream         *countingStream
+	streamMessages int
+	connected      bool
+	network        *libp2pProtocolNetwork[MessageType]
 
 	opts *MessageSenderOpts
 }
 
 // Open a stream to the remote peer
 func (s *streamMessageSender[MessageType]) Connect(ctx context.Context) (network.Stream, error) {
+	// checked on every send, so a sender stops once its peer is greylisted
+	if err := s.network.checkGreylist(s.to); err != nil {
+		return nil, err
+	}
 	if s.connected {
 		return s.stream, nil
 	}
@@ -90,8 +132,19 @@ func (s *streamMessageSender[MessageType]) Connect(ctx context.Context) (network
 	tctx, cancel := context.WithTimeout(ctx, s.opts.SendTimeout)
 	defer cancel()
 
-	if err := s.network.ConnectTo(tctx, s.to); err != nil {
-		return nil, err
+	switch s.opts.ConnectPolicy {
+	case FailIfNotConnected:
+		if s.network.host.Network().Connectedness(s.to) != network.Connected {
+			return nil, ErrNotConnected
+		}
+	case WaitForConnection:
+		if err := s.network.connectWaiters.wait(tctx, s.to, s.network.host.Network()); err != nil {
+			return nil, err
+		}
+	default:
+		if err := s.network.ConnectTo(tctx, s.to); err != nil {
+			return nil, err
+		}
 	}
 
 	stream, err := s.network.newStreamToPeer(tctx, s.to)
@@ -99,11 +152,142 @@ func (s *streamMessageSender[MessageType]) Connect(ctx context.Context) (network
 		return nil, err
 	}
 
-	s.stream = stream
+	s.stream = &countingStream{Stream: stream}
+	s.streamMessages = 0
 	s.connected = true
 	return s.stream, nil
 }
 
+// recycleStream closes the stream once it reaches the configured limits, so
+// the next message is sent on a new one
+func (s *streamMessageSender[MessageType]) recycleStream() {
+	s.streamMessages++
+	if (s.opts.StreamMessageLimit > 0 && s.streamMessages >= s.opts.StreamMessageLimit) ||
+		(s.opts.StreamByteLimit > 0 && s.stream.written >= s.opts.StreamByteLimit) {
+		_ = s.stream.Close()
+		s.connected = false
+	}
+}
+
+// sendAborts tracks the sends in progress to each peer, so they can be
+// aborted when the peer disconnects
+type sendAborts struct {
+	lk    sync.Mutex
+	sends map[peer.ID]map[*sendAbort]struct{}
+}
+
+type sendAbort struct {
+	cancel  context.CancelFunc
+	aborted int32
+}
+
+func (sa *sendAbort) isAborted() bool {
+	return atomic.LoadInt32(&sa.aborted) == 1
+}
+
+// watch returns a context that is cancelled if the peer disconnects
+func (sas *sendAborts) watch(ctx context.Context, p peer.ID) (context.Context, *sendAbort) {
+	ctx, cancel := context.WithCancel(ctx)
+	abort := &sendAbort{cancel: cancel}
+	sas.lk.Lock()
+	defer sas.lk.Unlock()
+	if sas.sends == nil {
+		sas.sends = make(map[peer.ID]map[*sendAbort]struct{})
+	}
+	if sas.sends[p] == nil {
+		sas.sends[p] = make(map[*sendAbort]struct{})
+	}
+	sas.sends[p][abort] = struct{}{}
+	return ctx, abort
+}
+
+func (sas *sendAborts) release(p peer.ID, abort *sendAbort) {
+	abort.cancel()
+	sas.lk.Lock()
+	defer sas.lk.Unlock()
+	delete(sas.sends[p], abort)
+	if len(sas.sends[p]) == 0 {
+		delete(sas.sends, p)
+	}
+}
+
+// abort cancels every send in progress to the peer
+func (sas *sendAborts) abort(p peer.ID) {
+	sas.lk.Lock()
+	defer sas.lk.Unlock()
+	for abort := range sas.sends[p] {
+		atomic.StoreInt32(&abort.aborted, 1)
+		abort.cancel()
+	}
+}
+
+// connectWaiters tracks senders waiting for peers to connect
+type connectWaiters struct {
+	lk      sync.Mutex
+	waiting map[peer.ID][]chan struct{}
+}
+
+// wait returns once the peer is connected, or fails with ErrNotConnected
+// when the context is done
+func (cws *connectWaiters) wait(ctx context.Context, p peer.ID, net network.Network) error {
+	connected := make(chan struct{})
+	cws.lk.Lock()
+	if cws.waiting == nil {
+		cws.waiting = make(map[peer.ID][]chan struct{})
+	}
+	cws.waiting[p] = append(cws.waiting[p], connected)
+	cws.lk.Unlock()
+
+	defer cws.remove(p, connected)
+
+	// check after registering, so a connection in between isn't missed
+	if net.Connectedness(p) == network.Connected {
+		return nil
+	}
+	select {
+	case <-connected:
+		return nil
+	case <-ctx.Done():
+		return ErrNotConnected
+	}
+}
+
+func (cws *connectWaiters) remove(p peer.ID, connected chan struct{}) {
+	cws.lk.Lock()
+	defer cws.lk.Unlock()
+	waiting := cws.waiting[p]
+	for i, waiter := range waiting {
+		if waiter == connected {
+			cws.waiting[p] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(cws.waiting[p]) == 0 {
+		delete(cws.waiting, p)
+	}
+}
+
+func (cws *connectWaiters) connected(p peer.ID) {
+	cws.lk.Lock()
+	defer cws.lk.Unlock()
+	for _, connected := range cws.waiting[p] {
+		close(connected)
+	}
+	delete(cws.waiting, p)
+}
+
+// countingStream counts the bytes written to a stream
+type countingStream struct {
+	network.Stream
+	written int64
+}
+
+func (cs *countingStream) Write(p []byte) (int, error) {
+	n, err := cs.Stream.Write(p)
+	cs.written += int64(n)
+	return n, err
+}
+
 // Reset the stream
 func (s *streamMessageSender[MessageType]) Reset() error {
 	if s.stream != nil {
@@ -119,16 +303,24 @@ func (s *streamMessageSender[MessageType]) Close() error {
 	return s.stream.Close()
 }
 
-// Indicates whether the peer supports HAVE / DONT_HAVE messages
+// Protocol returns the protocol negotiated on the current stream, with any
+// protocol prefix removed
 func (s *streamMessageSender[MessageType]) Protocol() protocol.ID {
-	return s.stream.Protocol()
+	return s.network.stripPrefix(s.stream.Protocol())
 }
 
-// Send a message to the peer, attempting multiple times
+// Send a message to the peer, attempting multiple times. The send is aborted
+// if the peer disconnects, rather than retrying until the attempts run out.
 func (s *streamMessageSender[MessageType]) SendMsg(ctx context.Context, msg MessageType) error {
-	return s.multiAttempt(ctx, func() error {
+	ctx, abort := s.network.sendAborts.watch(ctx, s.to)
+	defer s.network.sendAborts.release(s.to, abort)
+	err := s.multiAttempt(ctx, func() error {
 		return s.send(ctx, msg)
 	})
+	if err != nil && abort.isAborted() {
+		return fmt.Errorf("sending to %s: %w", s.to, ErrPeerDisconnected)
+	}
+	return err
 }
 
 // Perform a function with multiple attempts, and a timeout
@@ -150,6 +342,12 @@ func (s *streamMessageSender[MessageType]) multiAttempt(ctx context.Context, fn
 		default:
 		}
 
+		// Not connected and not allowed to dial, or greylisted, so retrying
+		// won't help
+		if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrPeerGreylisted) {
+			return err
+		}
+
 		// Protocol is not supported, so no need to try multiple times
 		if errors.Is(err, multistream.ErrNotSupported[protocol.ID]{}) {
 			s.network.connectEvtMgr.MarkUnresponsive(s.to)
@@ -162,6 +360,9 @@ func (s *streamMessageSender[MessageType]) multiAttempt(ctx context.Context, fn
 		// Failed too many times so mark the peer as unresponsive and return an error
 		if i == s.opts.MaxRetries-1 {
 			s.network.connectEvtMgr.MarkUnresponsive(s.to)
+			err = &SendError{Peer: s.to, Attempts: s.opts.MaxRetries, Err: err}
+			metrics.Add("send_failures", 1)
+			s.network.emitters.emitSendFailed(EvtSendFailed{ProtocolName: s.network.protocolName, Peer: s.to, Err: err})
 			return err
 		}
 
@@ -182,7 +383,7 @@ func (s *streamMessageSender[MessageType]) send(ctx context.Context, msg Message
 	stream, err := s.Connect(ctx)
 	if err != nil {
 		s.network.log.Infof("failed to open stream to %s: %s", s.to, err)
-		return err
+		return classifySendError(err)
 	}
 
 	// The send timeout includes the time required to connect
@@ -191,9 +392,10 @@ func (s *streamMessageSender[MessageType]) send(ctx context.Context, msg Message
 	timeout := s.opts.SendTimeout - time.Since(start)
 	if err = s.network.msgToStream(ctx, stream, msg, timeout); err != nil {
 		s.network.log.Infof("failed to send message to %s: %s", s.to, err)
-		return err
+		return classifySendError(err)
 	}
 
+	s.recycleStream()
 	return nil
 }
 
@@ -212,6 +414,25 @@ func (pn *libp2pProtocolNetwork[MessageType]) Latency(p peer.ID) time.Duration {
 	return pn.host.Peerstore().LatencyEWMA(p)
 }
 
+func (pn *libp2pProtocolNetwork[MessageType]) PeerInfo(p peer.ID) PeerInfo {
+	var info PeerInfo
+	if av, err := pn.host.Peerstore().Get(p, "AgentVersion"); err == nil {
+		info.AgentVersion, _ = av.(string)
+	}
+	for _, conn := range pn.host.Network().ConnsToPeer(p) {
+		info.Addrs = append(info.Addrs, conn.RemoteMultiaddr())
+	}
+	protos, err := pn.host.Peerstore().SupportsProtocols(p, pn.supportedProtocols...)
+	if err != nil {
+		pn.log.Debugf("error looking up protocols for %s: %s", p, err)
+		return info
+	}
+	for _, proto := range protos {
+		info.Protocols = append(info.Protocols, pn.stripPrefix(proto))
+	}
+	return info
+}
+
 func (pn *libp2pProtocolNetwork[MessageType]) stripPrefix(proto protocol.ID) protocol.ID {
 	return protocol.ID(strings.TrimPrefix(string(proto), string(pn.protocolPrefix)))
 }
@@ -229,12 +450,13 @@ func (pn *libp2pProtocolNetwork[MessageType]) msgToStream(ctx context.Context, s
 		pn.log.Warnf("error setting deadline: %s", err)
 	}
 
-	if err := pn.messageHandlerSelector.Select(s.Protocol()).ToNet(s.Conn().RemotePeer(), msg, s); err != nil {
+	if err := pn.messageHandlerSelector.Select(pn.stripPrefix(s.Protocol())).ToNet(s.Conn().RemotePeer(), msg, s); err != nil {
 		pn.log.Debugf("error: %s", err)
 		return err
 	}
 
 	atomic.AddUint64(&pn.stats.MessagesSent, 1)
+	metrics.Add("messages_sent", 1)
 
 	if err := s.SetWriteDeadline(time.Time{}); err != nil {
 		pn.log.Warnf("error resetting deadline: %s", err)
@@ -282,9 +504,16 @@ func (pn *libp2pProtocolNetwork[MessageType]) SendMessage(
 	p peer.ID,
 	outgoing MessageType) error {
 
+	if err := pn.checkGreylist(p); err != nil {
+		return err
+	}
+
 	tctx, cancel := context.WithTimeout(ctx, connectTimeout)
 	defer cancel()
 
+	if err := pn.ConnectTo(tctx, p); err != nil {
+		return err
+	}
 	s, err := pn.newStreamToPeer(tctx, p)
 	if err != nil {
 		return err
@@ -298,6 +527,15 @@ func (pn *libp2pProtocolNetwork[MessageType]) SendMessage(
 	return s.Close()
 }
 
+// checkGreylist fails with ErrPeerGreylisted if the peer is greylisted, so
+// nothing is sent to a peer whose streams are refused
+func (pn *libp2pProtocolNetwork[MessageType]) checkGreylist(p peer.ID) error {
+	if pn.greylist != nil && pn.greylist.IsGreylisted(p) {
+		return fmt.Errorf("sending to %s: %w", p, ErrPeerGreylisted)
+	}
+	return nil
+}
+
 func (pn *libp2pProtocolNetwork[MessageType]) newStreamToPeer(ctx context.Context, p peer.ID) (network.Stream, error) {
 	return pn.host.NewStream(ctx, p, pn.supportedProtocols...)
 }
@@ -316,16 +554,19 @@ func (pn *libp2pProtocolNetwork[MessageType]) Start(r ...Receiver[MessageType])
 	}
 	pn.host.Network().Notify((*netNotifiee[MessageType])(pn))
 	pn.connectEvtMgr.Start()
-
+	if err := pn.emitters.open(); err != nil {
+		pn.log.Warnf("not publishing events: %s", err)
+	}
 }
 
 func (pn *libp2pProtocolNetwork[MessageType]) Stop() {
 	pn.connectEvtMgr.Stop()
 	pn.host.Network().StopNotify((*netNotifiee[MessageType])(pn))
+	pn.emitters.close()
 }
 
 func (pn *libp2pProtocolNetwork[MessageType]) ConnectTo(ctx context.Context, p peer.ID) error {
-	return pn.host.Connect(ctx, peer.AddrInfo{ID: p})
+	return pn.dialer.connect(ctx, p)
 }
 
 func (pn *libp2pProtocolNetwork[MessageType]) DisconnectFrom(ctx context.Context, p peer.ID) error {
@@ -340,12 +581,24 @@ func (pn *libp2pProtocolNetwork[MessageType]) ConnectionManager() ConnManager {
 func (pn *libp2pProtocolNetwork[MessageType]) handleNewStream(s network.Stream) {
 	defer s.Close()
 
+	// label the handler so profiles can be broken down by peer and protocol
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels(
+		"peer", s.Conn().RemotePeer().String(),
+		"protocol", string(pn.stripPrefix(s.Protocol())),
+	)))
+
 	if len(pn.receivers) == 0 {
 		_ = s.Reset()
 		return
 	}
 
-	reader := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	if pn.greylist != nil && pn.greylist.IsGreylisted(s.Conn().RemotePeer()) {
+		pn.log.Debugf("refusing stream from greylisted peer %s", s.Conn().RemotePeer())
+		_ = s.Reset()
+		return
+	}
+
+	reader := &streamReader{ReadCloser: msgio.NewVarintReaderSize(s, pn.maxMessageSize)}
 	for {
 		received, err := pn.messageHandlerSelector.Select(pn.stripPrefix(s.Protocol())).FromMsgReader(s.Conn().RemotePeer(), reader)
 
@@ -358,6 +611,12 @@ func (pn *libp2pProtocolNetwork[MessageType]) handleNewStream(s network.Stream)
 					}
 				}()
 				pn.log.Debugf("bitswap net handleNewStream from %s error: %s", s.Conn().RemotePeer(), err)
+				if pn.greylist != nil && isProtocolViolation(err, reader.err) && pn.greylist.RecordViolation(s.Conn().RemotePeer()) {
+					pn.log.Infof("greylisting peer %s after repeated protocol violations", s.Conn().RemotePeer())
+					pn.connectEvtMgr.MarkUnresponsive(s.Conn().RemotePeer())
+					metrics.Add("peers_greylisted", 1)
+					pn.emitters.emitGreylisted(EvtPeerGreylisted{ProtocolName: pn.protocolName, Peer: s.Conn().RemotePeer()})
+				}
 			}
 			return
 		}
@@ -367,12 +626,42 @@ func (pn *libp2pProtocolNetwork[MessageType]) handleNewStream(s network.Stream)
 		pn.log.Debugf("bitswap net handleNewStream from %s", s.Conn().RemotePeer())
 		pn.connectEvtMgr.OnMessage(s.Conn().RemotePeer())
 		atomic.AddUint64(&pn.stats.MessagesRecvd, 1)
+		metrics.Add("messages_received", 1)
 		for _, v := range pn.receivers {
 			v.ReceiveMessage(ctx, p, received)
 		}
 	}
 }
 
+// streamReader records the last error reading from the stream itself, so a
+// failing stream can be told apart from a message that fails to decode
+type streamReader struct {
+	msgio.ReadCloser
+	err error
+}
+
+func (sr *streamReader) ReadMsg() ([]byte, error) {
+	msg, err := sr.ReadCloser.ReadMsg()
+	sr.err = err
+	return msg, err
+}
+
+// isProtocolViolation returns true if an error reading a message is the
+// peer's fault: an oversized message, a failed transform, or a message that
+// was read in full but could not be decoded. Streams that are reset or closed
+// early, e.g. when the remote message queue shuts down, are not violations.
+func isProtocolViolation(err error, readErr error) bool {
+	var transformErr TransformError
+	switch {
+	case errors.As(err, &transformErr), errors.Is(err, msgio.ErrMsgTooLarge):
+		return true
+	case readErr != nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	default:
+		return true
+	}
+}
+
 func (bsnet *libp2pProtocolNetwork[MessageType]) Stats() Stats {
 	return Stats{
 		MessagesRecvd: atomic.LoadUint64(&bsnet.stats.MessagesRecvd),
@@ -392,6 +681,8 @@ func (nn *netNotifiee[MessageType]) Connected(n network.Network, v network.Conn)
 		return
 	}
 
+	nn.impl().dialer.connected(v.RemotePeer())
+	nn.impl().connectWaiters.connected(v.RemotePeer())
 	nn.impl().connectEvtMgr.Connected(v.RemotePeer())
 }
 func (nn *netNotifiee[MessageType]) Disconnected(n network.Network, v network.Conn) {
@@ -400,6 +691,7 @@ func (nn *netNotifiee[MessageType]) Disconnected(n network.Network, v network.Co
 		return
 	}
 
+	nn.impl().sendAborts.abort(v.RemotePeer())
 	nn.impl().connectEvtMgr.Disconnected(v.RemotePeer())
 }
 func (nn *netNotifiee[MessageType]) OpenedStream(n network.Network, s network.Stream) {}
@@ -3,11 +3,13 @@ package network_test
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue/messagequeuetest"
 	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
 	tnet "github.com/libp2p/go-libp2p-testing/net"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -35,6 +37,7 @@ func (mhs *MessageHandlerSelector) Select(proto protocol.ID) pn.MessageHandler[*
 type receiver struct {
 	peers           map[peer.ID]struct{}
 	messageReceived chan struct{}
+	receivedErrors  chan error
 	connectionEvent chan bool
 	lastMessage     *testutil.Message
 	lastSender      peer.ID
@@ -46,6 +49,7 @@ func newReceiver() *receiver {
 		peers:           make(map[peer.ID]struct{}),
 		messageReceived: make(chan struct{}),
 		// Avoid blocking. 100 is good enough for tests.
+		receivedErrors:  make(chan error, 100),
 		connectionEvent: make(chan bool, 100),
 	}
 }
@@ -63,6 +67,10 @@ func (r *receiver) ReceiveMessage(
 }
 
 func (r *receiver) ReceiveError(p peer.ID, err error) {
+	select {
+	case r.receivedErrors <- err:
+	default:
+	}
 }
 
 func (r *receiver) PeerConnected(p peer.ID) {
@@ -90,7 +98,10 @@ type ErrHost struct {
 	lk        sync.Mutex
 	err       error
 	timingOut bool
-	streams   []*ErrStream
+	// streams opened to stalled time out on every write, as if the peer
+	// had stopped reading
+	stalled peer.ID
+	streams []*ErrStream
 }
 
 func (es *ErrStream) Write(b []byte) (int, error) {
@@ -138,7 +149,7 @@ func (eh *ErrHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID
 		return nil, context.DeadlineExceeded
 	}
 	stream, err := eh.Host.NewStream(ctx, p, pids...)
-	estrm := &ErrStream{Stream: stream, err: eh.err, timingOut: eh.timingOut}
+	estrm := &ErrStream{Stream: stream, err: eh.err, timingOut: eh.timingOut || p == eh.stalled}
 
 	eh.streams = append(eh.streams, estrm)
 	return estrm, err
@@ -379,6 +390,8 @@ func TestMessageSendTimeout(t *testing.T) {
 	if err == nil {
 		t.Fatal("Expected error from SednMsg")
 	}
+	require.ErrorIs(t, err, pn.ErrRetriesExhausted)
+	require.ErrorIs(t, err, pn.ErrSendTimeout)
 
 	select {
 	case <-time.After(500 * time.Millisecond):
@@ -593,3 +606,643 @@ func TestNetworkCounters(t *testing.T) {
 		testNetworkCounters(t, 10-n, n)
 	}
 }
+
+func TestPeerInfo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	pn1 := newNetwork(mn, p1)
+	pn2 := newNetwork(mn, p2)
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(newReceiver())
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, pn1.ConnectTo(ctx, p2.ID()))
+	provider, ok := pn1.(pn.PeerInfoProvider)
+	require.True(t, ok)
+
+	// identify runs asynchronously after connecting
+	require.Eventually(t, func() bool {
+		return len(provider.PeerInfo(p2.ID()).Protocols) == len(testutil.DefaultProtocols)
+	}, time.Second, 10*time.Millisecond)
+
+	info := provider.PeerInfo(p2.ID())
+	require.ElementsMatch(t, testutil.DefaultProtocols, info.Protocols)
+	require.NotEmpty(t, info.AgentVersion)
+	require.NotEmpty(t, info.Addrs)
+	require.Len(t, info.IPs(), len(info.Addrs))
+
+	unknown := provider.PeerInfo(testutil.GeneratePeers(1)[0])
+	require.Empty(t, unknown.AgentVersion)
+	require.Empty(t, unknown.Protocols)
+	require.Empty(t, unknown.Addrs)
+}
+
+func TestProtocolPrefix(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	h2, err := mn.AddPeer(p2.PrivateKey(), p2.Address())
+	require.NoError(t, err)
+	protocols := []protocol.ID{testutil.ProtocolMockV1}
+	pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h1, &MessageHandlerSelector{}, pn.Prefix("/prefix"), pn.SupportedProtocols(protocols))
+	pn2 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h2, &MessageHandlerSelector{}, pn.Prefix("/prefix"), pn.SupportedProtocols(protocols))
+	r2 := newReceiver()
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+
+	ms, err := pn1.NewMessageSender(ctx, p2.ID(), &pn.MessageSenderOpts{SendTimeout: time.Second})
+	require.NoError(t, err)
+	defer ms.Close()
+
+	// senders report the protocol without its prefix, and serialize with the
+	// handler selected for it
+	require.Equal(t, testutil.ProtocolMockV1, ms.Protocol())
+	msg := &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+	require.NoError(t, ms.SendMsg(ctx, msg))
+	testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "message was not received")
+	require.Equal(t, msg, r2.lastMessage)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	pn1 := newNetwork(mn, p1)
+	h2, err := mn.AddPeer(p2.PrivateKey(), p2.Address())
+	require.NoError(t, err)
+	greylist := pn.NewGreylist(1, time.Hour, time.Hour)
+	pn2 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h2, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.MaxMessageSize(256), pn.GreylistPeers(greylist))
+	r1 := newReceiver()
+	r2 := newReceiver()
+	pn1.Start(r1)
+	t.Cleanup(pn1.Stop)
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, pn1.ConnectTo(ctx, p2.ID()))
+
+	small := &testutil.Message{Id: testutil.RandomBytes(10), Payload: testutil.RandomBytes(100)}
+	require.NoError(t, pn1.SendMessage(ctx, p2.ID(), small))
+	testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "message under the limit was not received")
+
+	large := &testutil.Message{Id: testutil.RandomBytes(10), Payload: testutil.RandomBytes(1000)}
+	_ = pn1.SendMessage(ctx, p2.ID(), large)
+	var receivedErr error
+	testutil.AssertReceive(ctx, t, r2.receivedErrors, &receivedErr, "oversized message was not reported")
+	require.ErrorIs(t, receivedErr, pn.ErrMessageTooLarge)
+	require.Eventually(t, func() bool { return greylist.IsGreylisted(p1.ID()) }, time.Second, 10*time.Millisecond)
+}
+
+func TestResetStreamIsNotViolation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	h2, err := mn.AddPeer(p2.PrivateKey(), p2.Address())
+	require.NoError(t, err)
+	greylist := pn.NewGreylist(1, time.Hour, time.Hour)
+	pn2 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h2, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.GreylistPeers(greylist))
+	r2 := newReceiver()
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: p2.ID()}))
+
+	// a stream reset partway through a message is not the peer's fault
+	s, err := h1.NewStream(ctx, p2.ID(), testutil.ProtocolMockV1)
+	require.NoError(t, err)
+	_, err = s.Write([]byte{100, 1, 2, 3})
+	require.NoError(t, err)
+	// give the partial message time to arrive before resetting
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, s.Reset())
+	testutil.AssertReceive(ctx, t, r2.receivedErrors, &err, "reset stream was not reported")
+	require.False(t, greylist.IsGreylisted(p1.ID()))
+
+	// a message read in full that fails to decode is
+	s, err = h1.NewStream(ctx, p2.ID(), testutil.ProtocolMockV1)
+	require.NoError(t, err)
+	_, err = s.Write([]byte{4, 0xff, 0xff, 0xff, 0xff})
+	require.NoError(t, err)
+	testutil.AssertReceive(ctx, t, r2.receivedErrors, &err, "malformed message was not reported")
+	require.Eventually(t, func() bool { return greylist.IsGreylisted(p1.ID()) }, time.Second, 10*time.Millisecond)
+	_ = s.Reset()
+}
+
+func TestSendToGreylistedPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	greylist := pn.NewGreylist(1, time.Hour, time.Hour)
+	pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h1, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.GreylistPeers(greylist))
+	pn2 := newNetwork(mn, p2)
+	r2 := &channelReceiver{received: make(chan *testutil.Message, 16)}
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+
+	ms, err := pn1.NewMessageSender(ctx, p2.ID(), &pn.MessageSenderOpts{SendErrorBackoff: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer ms.Close()
+	require.NoError(t, ms.SendMsg(ctx, &testutil.Message{Id: testutil.RandomBytes(100)}))
+	testutil.AssertDoesReceive(ctx, t, r2.received, "message was not received")
+
+	// a denied peer is greylisted without being marked unresponsive, so
+	// outbound sends must check for it
+	greylist.Deny(p2.ID())
+	err = ms.SendMsg(ctx, &testutil.Message{Id: testutil.RandomBytes(100)})
+	require.ErrorIs(t, err, pn.ErrPeerGreylisted)
+	_, err = pn1.NewMessageSender(ctx, p2.ID(), &pn.MessageSenderOpts{})
+	require.ErrorIs(t, err, pn.ErrPeerGreylisted)
+	err = pn1.SendMessage(ctx, p2.ID(), &testutil.Message{Id: testutil.RandomBytes(100)})
+	require.ErrorIs(t, err, pn.ErrPeerGreylisted)
+	testutil.AssertChannelEmpty(t, r2.received, "greylisted peer should not receive messages")
+
+	greylist.ClearOverride(p2.ID())
+	require.NoError(t, pn1.SendMessage(ctx, p2.ID(), &testutil.Message{Id: testutil.RandomBytes(100)}))
+	testutil.AssertDoesReceive(ctx, t, r2.received, "message was not received once the peer was cleared")
+}
+
+func TestMaxMessageSizeAfterTransform(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	pn1 := newNetwork(mn, p1)
+	h2, err := mn.AddPeer(p2.PrivateKey(), p2.Address())
+	require.NoError(t, err)
+	// the incoming transform expands messages well past the limit, as a
+	// decompressing transform might
+	expand := func(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+		return append(data, make([]byte, 1000)...), nil
+	}
+	ts := pn.NewTransformingSelector[*testutil.Message](&MessageHandlerSelector{}, pn.IncomingTransform(expand))
+	pn2 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h2, ts, pn.SupportedProtocols(testutil.DefaultProtocols), pn.MaxMessageSize(256))
+	r2 := newReceiver()
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(r2)
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, pn1.ConnectTo(ctx, p2.ID()))
+
+	small := &testutil.Message{Id: testutil.RandomBytes(10), Payload: testutil.RandomBytes(100)}
+	_ = pn1.SendMessage(ctx, p2.ID(), small)
+	var receivedErr error
+	testutil.AssertReceive(ctx, t, r2.receivedErrors, &receivedErr, "oversized transformed message was not reported")
+	require.ErrorIs(t, receivedErr, pn.ErrMessageTooLarge)
+}
+
+func TestStreamReuse(t *testing.T) {
+	testCases := map[string]struct {
+		opts            pn.MessageSenderOpts
+		expectedStreams int
+	}{
+		"single long-lived stream": {
+			expectedStreams: 1,
+		},
+		"stream per message": {
+			opts:            pn.MessageSenderOpts{StreamMessageLimit: 1},
+			expectedStreams: 4,
+		},
+		"recycle after two messages": {
+			opts:            pn.MessageSenderOpts{StreamMessageLimit: 2},
+			expectedStreams: 2,
+		},
+		"recycle after bytes written": {
+			opts:            pn.MessageSenderOpts{StreamByteLimit: 1},
+			expectedStreams: 4,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			mn := mocknet.New()
+			defer mn.Close()
+
+			p1 := tnet.RandIdentityOrFatal(t)
+			p2 := tnet.RandIdentityOrFatal(t)
+			h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+			require.NoError(t, err)
+			eh1 := &ErrHost{Host: h1}
+			pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", eh1, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols))
+			pn2 := newNetwork(mn, p2)
+			r2 := newReceiver()
+			pn1.Start(newReceiver())
+			t.Cleanup(pn1.Stop)
+			pn2.Start(r2)
+			t.Cleanup(pn2.Stop)
+			require.NoError(t, mn.LinkAll())
+
+			ms, err := pn1.NewMessageSender(ctx, p2.ID(), &data.opts)
+			require.NoError(t, err)
+			defer ms.Close()
+			for i := 0; i < 4; i++ {
+				msg := &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+				require.NoError(t, ms.SendMsg(ctx, msg))
+				testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "message not received")
+			}
+
+			eh1.lk.Lock()
+			defer eh1.lk.Unlock()
+			require.Len(t, eh1.streams, data.expectedStreams)
+		})
+	}
+}
+
+func TestDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h1, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.DialLimits(1, time.Hour))
+	pn2 := newNetwork(mn, p2)
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(newReceiver())
+	t.Cleanup(pn2.Stop)
+
+	// the peers are not linked, so the first dial fails and the next is not attempted
+	err = pn1.ConnectTo(ctx, p2.ID())
+	require.Error(t, err)
+	require.NotErrorIs(t, err, pn.ErrDialBackoff)
+	require.NoError(t, mn.LinkAll())
+	require.ErrorIs(t, pn1.ConnectTo(ctx, p2.ID()), pn.ErrDialBackoff)
+	require.ErrorIs(t, pn1.SendMessage(ctx, p2.ID(), &testutil.Message{Id: testutil.RandomBytes(100)}), pn.ErrDialBackoff)
+
+	// the backoff is cleared when the peer connects to us
+	require.NoError(t, pn2.ConnectTo(ctx, p1.ID()))
+	require.Eventually(t, func() bool { return pn1.ConnectTo(ctx, p2.ID()) == nil }, time.Second, 10*time.Millisecond)
+}
+
+// blockingDialHost holds dials until released, tracking how many run at once
+type blockingDialHost struct {
+	host.Host
+	release chan struct{}
+
+	lk        sync.Mutex
+	dials     int
+	active    int
+	maxActive int
+}
+
+func (bh *blockingDialHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	bh.lk.Lock()
+	bh.dials++
+	bh.active++
+	if bh.active > bh.maxActive {
+		bh.maxActive = bh.active
+	}
+	bh.lk.Unlock()
+	defer func() {
+		bh.lk.Lock()
+		bh.active--
+		bh.lk.Unlock()
+	}()
+
+	select {
+	case <-bh.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return bh.Host.Connect(ctx, pi)
+}
+
+func (bh *blockingDialHost) counts() (dials int, maxActive int) {
+	bh.lk.Lock()
+	defer bh.lk.Unlock()
+	return bh.dials, bh.maxActive
+}
+
+func TestDialManager(t *testing.T) {
+	testCases := map[string]func(ctx context.Context, t *testing.T, bh *blockingDialHost, pn1 pn.ProtocolNetwork[*testutil.Message], peers []peer.ID){
+		"coalesces dials, each caller waiting on its own context": func(ctx context.Context, t *testing.T, bh *blockingDialHost, pn1 pn.ProtocolNetwork[*testutil.Message], peers []peer.ID) {
+			// the caller that starts the dial gives up before it completes
+			shortCtx, shortCancel := context.WithCancel(ctx)
+			shortErr := make(chan error, 1)
+			go func() { shortErr <- pn1.ConnectTo(shortCtx, peers[0]) }()
+			require.Eventually(t, func() bool { dials, _ := bh.counts(); return dials == 1 }, time.Second, time.Millisecond)
+			longErr := make(chan error, 1)
+			go func() { longErr <- pn1.ConnectTo(ctx, peers[0]) }()
+			time.Sleep(20 * time.Millisecond)
+			shortCancel()
+			var err error
+			testutil.AssertReceive(ctx, t, shortErr, &err, "abandoned connect did not return")
+			require.ErrorIs(t, err, context.Canceled)
+
+			close(bh.release)
+			testutil.AssertReceive(ctx, t, longErr, &err, "dial did not complete")
+			require.NoError(t, err)
+			dials, _ := bh.counts()
+			require.Equal(t, 1, dials)
+		},
+		"abandoned dial does not back off": func(ctx context.Context, t *testing.T, bh *blockingDialHost, pn1 pn.ProtocolNetwork[*testutil.Message], peers []peer.ID) {
+			shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer shortCancel()
+			require.ErrorIs(t, pn1.ConnectTo(shortCtx, peers[0]), context.DeadlineExceeded)
+
+			close(bh.release)
+			require.NoError(t, pn1.ConnectTo(ctx, peers[0]))
+			dials, _ := bh.counts()
+			require.Equal(t, 2, dials)
+		},
+		"limits concurrent dials": func(ctx context.Context, t *testing.T, bh *blockingDialHost, pn1 pn.ProtocolNetwork[*testutil.Message], peers []peer.ID) {
+			errs := make(chan error, len(peers))
+			for _, p := range peers {
+				p := p
+				go func() { errs <- pn1.ConnectTo(ctx, p) }()
+			}
+			require.Eventually(t, func() bool { dials, _ := bh.counts(); return dials == 1 }, time.Second, time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			dials, _ := bh.counts()
+			require.Equal(t, 1, dials)
+
+			close(bh.release)
+			for range peers {
+				var err error
+				testutil.AssertReceive(ctx, t, errs, &err, "dial did not complete")
+				require.NoError(t, err)
+			}
+			dials, maxActive := bh.counts()
+			require.Equal(t, len(peers), dials)
+			require.Equal(t, 1, maxActive)
+		},
+	}
+	for testCase, testDials := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			mn := mocknet.New()
+			defer mn.Close()
+
+			p1 := tnet.RandIdentityOrFatal(t)
+			h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+			require.NoError(t, err)
+			bh := &blockingDialHost{Host: h1, release: make(chan struct{})}
+			pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", bh, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.DialLimits(1, time.Hour))
+			pn1.Start(newReceiver())
+			t.Cleanup(pn1.Stop)
+			var peers []peer.ID
+			for i := 0; i < 2; i++ {
+				h, err := mn.GenPeer()
+				require.NoError(t, err)
+				peers = append(peers, h.ID())
+			}
+			require.NoError(t, mn.LinkAll())
+
+			testDials(ctx, t, bh, pn1, peers)
+		})
+	}
+}
+
+func TestSendAbortedOnDisconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	p2 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	eh1 := &ErrHost{Host: h1}
+	pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", eh1, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols))
+	pn2 := newNetwork(mn, p2)
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	pn2.Start(newReceiver())
+	t.Cleanup(pn2.Stop)
+	require.NoError(t, mn.LinkAll())
+
+	ms, err := pn1.NewMessageSender(ctx, p2.ID(), &pn.MessageSenderOpts{
+		MaxRetries:       3,
+		SendTimeout:      time.Second,
+		SendErrorBackoff: time.Second,
+	})
+	require.NoError(t, err)
+	defer ms.Close()
+
+	// every attempt fails, so without the disconnect the send would take
+	// over two seconds of backoff to give up
+	eh1.setError(errMockNetErr)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = pn1.DisconnectFrom(ctx, p2.ID())
+	}()
+	start := time.Now()
+	err = ms.SendMsg(ctx, &testutil.Message{Id: testutil.RandomBytes(100)})
+	require.ErrorIs(t, err, pn.ErrPeerDisconnected)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestConnectPolicy(t *testing.T) {
+	testCases := map[string]func(ctx context.Context, t *testing.T, pn1 pn.ProtocolNetwork[*testutil.Message], pn2 pn.ProtocolNetwork[*testutil.Message], p1, p2 peer.ID){
+		"fail if not connected": func(ctx context.Context, t *testing.T, pn1 pn.ProtocolNetwork[*testutil.Message], pn2 pn.ProtocolNetwork[*testutil.Message], p1, p2 peer.ID) {
+			opts := &pn.MessageSenderOpts{ConnectPolicy: pn.FailIfNotConnected}
+			_, err := pn1.NewMessageSender(ctx, p2, opts)
+			require.ErrorIs(t, err, pn.ErrNotConnected)
+
+			require.NoError(t, pn1.ConnectTo(ctx, p2))
+			ms, err := pn1.NewMessageSender(ctx, p2, opts)
+			require.NoError(t, err)
+			require.NoError(t, ms.Close())
+		},
+		"wait for connection": func(ctx context.Context, t *testing.T, pn1 pn.ProtocolNetwork[*testutil.Message], pn2 pn.ProtocolNetwork[*testutil.Message], p1, p2 peer.ID) {
+			// the wait is bounded by the send timeout, not just the context
+			opts := &pn.MessageSenderOpts{ConnectPolicy: pn.WaitForConnection, SendTimeout: 50 * time.Millisecond}
+			start := time.Now()
+			_, err := pn1.NewMessageSender(ctx, p2, opts)
+			require.ErrorIs(t, err, pn.ErrNotConnected)
+			require.Less(t, time.Since(start), 500*time.Millisecond)
+
+			// and ends early if the context is done first
+			shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer shortCancel()
+			opts.SendTimeout = time.Minute
+			_, err = pn1.NewMessageSender(shortCtx, p2, opts)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+
+			// the sender is created once the peer connects to us
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				_ = pn2.ConnectTo(ctx, p1)
+			}()
+			opts.SendTimeout = time.Second
+			ms, err := pn1.NewMessageSender(ctx, p2, opts)
+			require.NoError(t, err)
+			require.NoError(t, ms.Close())
+		},
+	}
+	for testCase, run := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			mn := mocknet.New()
+			defer mn.Close()
+
+			p1 := tnet.RandIdentityOrFatal(t)
+			p2 := tnet.RandIdentityOrFatal(t)
+			pn1 := newNetwork(mn, p1)
+			pn2 := newNetwork(mn, p2)
+			pn1.Start(newReceiver())
+			t.Cleanup(pn1.Stop)
+			pn2.Start(newReceiver())
+			t.Cleanup(pn2.Stop)
+			require.NoError(t, mn.LinkAll())
+			run(ctx, t, pn1, pn2, p1.ID(), p2.ID())
+		})
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1 := tnet.RandIdentityOrFatal(t)
+	h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+	require.NoError(t, err)
+	pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", h1, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols), pn.PublishEvents(), pn.DialLimits(0, time.Minute))
+	pn1.Start(newReceiver())
+	t.Cleanup(pn1.Stop)
+	sub, err := h1.EventBus().Subscribe(new(pn.EvtSendFailed))
+	require.NoError(t, err)
+	throttledSub, err := h1.EventBus().Subscribe(new(pn.EvtPeerThrottled))
+	require.NoError(t, err)
+
+	// the peer is not on the network, so connecting fails
+	unreachable := testutil.GeneratePeers(1)[0]
+	_, err = pn1.NewMessageSender(ctx, unreachable, &pn.MessageSenderOpts{
+		MaxRetries:       2,
+		SendTimeout:      10 * time.Millisecond,
+		SendErrorBackoff: 10 * time.Millisecond,
+	})
+	require.ErrorIs(t, err, pn.ErrRetriesExhausted)
+
+	var evt interface{}
+	testutil.AssertReceive(ctx, t, sub.Out(), &evt, "did not publish send failure")
+	sendFailed := evt.(pn.EvtSendFailed)
+	require.Equal(t, "mock", sendFailed.ProtocolName)
+	require.Equal(t, unreachable, sendFailed.Peer)
+	require.ErrorIs(t, sendFailed.Err, pn.ErrRetriesExhausted)
+
+	// the failed dial also put the peer in dial backoff
+	testutil.AssertReceive(ctx, t, throttledSub.Out(), &evt, "did not publish throttled peer")
+	throttled := evt.(pn.EvtPeerThrottled)
+	require.Equal(t, "mock", throttled.ProtocolName)
+	require.Equal(t, unreachable, throttled.Peer)
+	require.True(t, throttled.Until.After(time.Now()))
+	require.Error(t, throttled.Err)
+
+	// stopping closes the emitters, so restarting doesn't leak them
+	require.NoError(t, sub.Close())
+	require.NoError(t, throttledSub.Close())
+	pn1.Stop()
+	pn1.Start(newReceiver())
+	pn1.Stop()
+	require.NotContains(t, h1.EventBus().GetAllEventTypes(), reflect.TypeOf(pn.EvtSendFailed{}))
+	require.NotContains(t, h1.EventBus().GetAllEventTypes(), reflect.TypeOf(pn.EvtPeerGreylisted{}))
+	require.NotContains(t, h1.EventBus().GetAllEventTypes(), reflect.TypeOf(pn.EvtPeerThrottled{}))
+	pn1.Start(newReceiver())
+}
+
+func TestLibp2pNetworkConformance(t *testing.T) {
+	messagequeuetest.TestMessageNetwork(t, func(t *testing.T) messagequeuetest.Harness[*testutil.Message] {
+		mn := mocknet.New()
+		t.Cleanup(func() { _ = mn.Close() })
+
+		p1 := tnet.RandIdentityOrFatal(t)
+		p2 := tnet.RandIdentityOrFatal(t)
+		p3 := tnet.RandIdentityOrFatal(t)
+		h1, err := mn.AddPeer(p1.PrivateKey(), p1.Address())
+		require.NoError(t, err)
+		pn1 := pn.NewFromLibp2pHost[*testutil.Message]("mock", &ErrHost{Host: h1, stalled: p3.ID()}, &MessageHandlerSelector{}, pn.SupportedProtocols(testutil.DefaultProtocols))
+		pn2 := newNetwork(mn, p2)
+		pn3 := newNetwork(mn, p3)
+		r2 := &channelReceiver{received: make(chan *testutil.Message, 16)}
+		pn1.Start(newReceiver())
+		t.Cleanup(pn1.Stop)
+		pn2.Start(r2)
+		t.Cleanup(pn2.Stop)
+		pn3.Start(newReceiver())
+		t.Cleanup(pn3.Stop)
+		require.NoError(t, mn.LinkAll())
+
+		return messagequeuetest.Harness[*testutil.Message]{
+			Network:         pn1,
+			Peer:            p2.ID(),
+			UnreachablePeer: tnet.RandIdentityOrFatal(t).ID(),
+			StalledPeer:     p3.ID(),
+			Received:        r2.received,
+			NewMessage: func() *testutil.Message {
+				return &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+			},
+		}
+	})
+}
+
+type channelReceiver struct {
+	received chan *testutil.Message
+}
+
+func (r *channelReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming *testutil.Message) {
+	r.received <- incoming
+}
+
+func (r *channelReceiver) ReceiveError(p peer.ID, err error) {}
+func (r *channelReceiver) PeerConnected(p peer.ID)           {}
+func (r *channelReceiver) PeerDisconnected(p peer.ID)        {}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var loopbackLog = logging.Logger("protocolnetwork/loopback")
+
+var errLoopbackStopped = errors.New("loopback network stopped")
+
+// ErrLoopbackQueueFull is returned when sending a message to self while
+// LoopbackQueueSize messages to self are already waiting to be delivered
+var ErrLoopbackQueueFull = errors.New("loopback queue full")
+
+// LoopbackQueueSize is the most messages to self a loopback network holds
+// before they are delivered to its receivers
+const LoopbackQueueSize = 1024
+
+// NewLoopbackNetwork wraps a ProtocolNetwork so that messages a node sends to
+// itself are delivered to its own receivers without touching the underlying
+// network, e.g. so requests for data the node already has can take the same
+// code path as requests to remote peers. Messages to self are delivered in
+// order, and appear to have been sent over the given protocol. Messages to
+// other peers pass through to the underlying network.
+func NewLoopbackNetwork[MessageType Message[MessageType]](self peer.ID, proto protocol.ID, network ProtocolNetwork[MessageType]) ProtocolNetwork[MessageType] {
+	return &loopbackNetwork[MessageType]{
+		ProtocolNetwork: network,
+		self:            self,
+		protocol:        proto,
+		queue:           make(chan MessageType, LoopbackQueueSize),
+		stopped:         make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+type loopbackNetwork[MessageType Message[MessageType]] struct {
+	ProtocolNetwork[MessageType]
+	self     peer.ID
+	protocol protocol.ID
+	sent     uint64
+
+	lk        sync.Mutex
+	receivers []Receiver[MessageType]
+	started   bool
+	isStopped bool
+	queue     chan MessageType
+	stopped   chan struct{}
+	done      chan struct{}
+}
+
+// Start starts delivering messages to self. Calling it again only updates the
+// receivers.
+func (ln *loopbackNetwork[MessageType]) Start(r ...Receiver[MessageType]) {
+	ln.lk.Lock()
+	ln.receivers = r
+	if !ln.started {
+		ln.started = true
+		go ln.run()
+	}
+	ln.lk.Unlock()
+	ln.ProtocolNetwork.Start(r...)
+}
+
+// Stop delivers any messages to self that are already queued before it
+// returns, so it must not be called from a receiver
+func (ln *loopbackNetwork[MessageType]) Stop() {
+	ln.lk.Lock()
+	wasStopped, started := ln.isStopped, ln.started
+	ln.isStopped = true
+	ln.lk.Unlock()
+	if !wasStopped {
+		close(ln.stopped)
+		if started {
+			<-ln.done
+		} else if dropped := len(ln.queue); dropped > 0 {
+			loopbackLog.Warnf("loopback network stopped before starting, dropping %d messages to self", dropped)
+		}
+	}
+	ln.ProtocolNetwork.Stop()
+}
+
+func (ln *loopbackNetwork[MessageType]) SendMessage(ctx context.Context, p peer.ID, msg MessageType) error {
+	if p != ln.self {
+		return ln.ProtocolNetwork.SendMessage(ctx, p, msg)
+	}
+	return ln.enqueue(msg)
+}
+
+func (ln *loopbackNetwork[MessageType]) ConnectTo(ctx context.Context, p peer.ID) error {
+	if p != ln.self {
+		return ln.ProtocolNetwork.ConnectTo(ctx, p)
+	}
+	return nil
+}
+
+func (ln *loopbackNetwork[MessageType]) DisconnectFrom(ctx context.Context, p peer.ID) error {
+	if p != ln.self {
+		return ln.ProtocolNetwork.DisconnectFrom(ctx, p)
+	}
+	return nil
+}
+
+func (ln *loopbackNetwork[MessageType]) NewMessageSender(ctx context.Context, p peer.ID, opts *MessageSenderOpts) (MessageSender[MessageType], error) {
+	if p != ln.self {
+		return ln.ProtocolNetwork.NewMessageSender(ctx, p, opts)
+	}
+	return (*loopbackSender[MessageType])(ln), nil
+}
+
+// Stats includes messages sent to self in both counts
+func (ln *loopbackNetwork[MessageType]) Stats() Stats {
+	stats := ln.ProtocolNetwork.Stats()
+	sent := atomic.LoadUint64(&ln.sent)
+	stats.MessagesSent += sent
+	stats.MessagesRecvd += sent
+	return stats
+}
+
+// PeerInfo returns the loopback protocol for self, and otherwise forwards to
+// the underlying network if it is a PeerInfoProvider
+func (ln *loopbackNetwork[MessageType]) PeerInfo(p peer.ID) PeerInfo {
+	if p == ln.self {
+		return PeerInfo{Protocols: []protocol.ID{ln.protocol}}
+	}
+	if provider, ok := ln.ProtocolNetwork.(PeerInfoProvider); ok {
+		return provider.PeerInfo(p)
+	}
+	return PeerInfo{}
+}
+
+func (ln *loopbackNetwork[MessageType]) enqueue(msg MessageType) error {
+	ln.lk.Lock()
+	defer ln.lk.Unlock()
+	if ln.isStopped {
+		return errLoopbackStopped
+	}
+	// clone the message, as it would be copied by sending it over the wire
+	select {
+	case ln.queue <- msg.Clone():
+	default:
+		return ErrLoopbackQueueFull
+	}
+	atomic.AddUint64(&ln.sent, 1)
+	return nil
+}
+
+// run delivers queued messages to the receivers in order, so a sender is
+// never blocked on its own receivers. Once stopped, nothing more can be
+// queued, so it delivers what remains and returns.
+func (ln *loopbackNetwork[MessageType]) run() {
+	defer close(ln.done)
+	for {
+		select {
+		case msg := <-ln.queue:
+			ln.deliver(msg)
+		case <-ln.stopped:
+			for {
+				select {
+				case msg := <-ln.queue:
+					ln.deliver(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ln *loopbackNetwork[MessageType]) deliver(msg MessageType) {
+	ln.lk.Lock()
+	receivers := ln.receivers
+	ln.lk.Unlock()
+	for _, receiver := range receivers {
+		receiver.ReceiveMessage(context.Background(), ln.self, msg)
+	}
+}
+
+type loopbackSender[MessageType Message[MessageType]] loopbackNetwork[MessageType]
+
+func (ls *loopbackSender[MessageType]) SendMsg(_ context.Context, msg MessageType) error {
+	return (*loopbackNetwork[MessageType])(ls).enqueue(msg)
+}
+
+func (ls *loopbackSender[MessageType]) Close() error {
+	return nil
+}
+
+func (ls *loopbackSender[MessageType]) Reset() error {
+	return nil
+}
+
+func (ls *loopbackSender[MessageType]) Protocol() protocol.ID {
+	return ls.protocol
+}
@@ -0,0 +1,147 @@
+package network_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	delay "github.com/ipfs/go-ipfs-delay"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue/messagequeuetest"
+	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
+	"github.com/ipfs/go-protocolnetwork/pkg/testnet"
+)
+
+func TestLoopbackNetworkConformance(t *testing.T) {
+	messagequeuetest.TestMessageNetwork(t, func(t *testing.T) messagequeuetest.Harness[*testutil.Message] {
+		net := testnet.VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+		self := tnet.RandIdentityOrFatal(t)
+		loopback := pn.NewLoopbackNetwork(self.ID(), testutil.ProtocolMockV2, net.Adapter(self))
+		received := make(chan *testutil.Message, 16)
+		loopback.Start(&channelReceiver{received})
+		t.Cleanup(loopback.Stop)
+		return messagequeuetest.Harness[*testutil.Message]{
+			Network:         loopback,
+			Peer:            self.ID(),
+			UnreachablePeer: tnet.RandIdentityOrFatal(t).ID(),
+			Received:        received,
+			NewMessage: func() *testutil.Message {
+				return &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+			},
+		}
+	})
+}
+
+func TestLoopbackNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	net := testnet.VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+	self := tnet.RandIdentityOrFatal(t)
+	remote := tnet.RandIdentityOrFatal(t)
+	loopback := pn.NewLoopbackNetwork(self.ID(), testutil.ProtocolMockV2, net.Adapter(self))
+	selfReceived := make(chan *testutil.Message, 1)
+	loopback.Start(&channelReceiver{selfReceived})
+	defer loopback.Stop()
+	remoteNetwork := net.Adapter(remote)
+	remoteReceived := make(chan *testutil.Message, 1)
+	remoteNetwork.Start(&channelReceiver{remoteReceived})
+	defer remoteNetwork.Stop()
+
+	// messages to self are delivered locally, as a copy
+	msg := &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+	require.NoError(t, loopback.SendMessage(ctx, self.ID(), msg))
+	var received *testutil.Message
+	testutil.AssertReceive(ctx, t, selfReceived, &received, "message to self not received")
+	require.Equal(t, msg, received)
+	require.NotSame(t, msg, received)
+	require.Equal(t, []protocol.ID{testutil.ProtocolMockV2}, loopback.(pn.PeerInfoProvider).PeerInfo(self.ID()).Protocols)
+	require.Equal(t, pn.Stats{MessagesSent: 1, MessagesRecvd: 1}, loopback.Stats())
+
+	// messages to other peers go over the underlying network
+	require.NoError(t, loopback.SendMessage(ctx, remote.ID(), msg))
+	testutil.AssertReceive(ctx, t, remoteReceived, &received, "message to remote peer not received")
+	require.Equal(t, msg, received)
+	testutil.AssertChannelEmpty(t, selfReceived, "message to remote peer should not be delivered locally")
+}
+
+func TestLoopbackQueue(t *testing.T) {
+	newLoopback := func(t *testing.T) (pn.ProtocolNetwork[*testutil.Message], peer.ID) {
+		net := testnet.VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+		self := tnet.RandIdentityOrFatal(t)
+		return pn.NewLoopbackNetwork(self.ID(), testutil.ProtocolMockV2, net.Adapter(self)), self.ID()
+	}
+	newMessage := func() *testutil.Message {
+		return &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+	}
+
+	t.Run("is bounded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		loopback, self := newLoopback(t)
+		// the receiver doesn't take any messages until the queue fills
+		received := make(chan *testutil.Message)
+		loopback.Start(&channelReceiver{received})
+
+		var err error
+		sent := 0
+		for ; sent <= pn.LoopbackQueueSize+1; sent++ {
+			if err = loopback.SendMessage(ctx, self, newMessage()); err != nil {
+				break
+			}
+		}
+		require.ErrorIs(t, err, pn.ErrLoopbackQueueFull)
+		// one message may already be with the receiver
+		require.GreaterOrEqual(t, sent, pn.LoopbackQueueSize)
+		require.LessOrEqual(t, sent, pn.LoopbackQueueSize+1)
+
+		go func() {
+			for range received {
+			}
+		}()
+		loopback.Stop()
+		close(received)
+	})
+
+	t.Run("starting twice delivers in order", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		loopback, self := newLoopback(t)
+		received := make(chan *testutil.Message, 100)
+		loopback.Start(&channelReceiver{received})
+		loopback.Start(&channelReceiver{received})
+		defer loopback.Stop()
+
+		var sent []*testutil.Message
+		for i := 0; i < 100; i++ {
+			msg := newMessage()
+			sent = append(sent, msg)
+			require.NoError(t, loopback.SendMessage(ctx, self, msg))
+		}
+		for _, msg := range sent {
+			var next *testutil.Message
+			testutil.AssertReceive(ctx, t, received, &next, "message to self not received")
+			require.Equal(t, msg, next)
+		}
+		testutil.AssertChannelEmpty(t, received, "messages should be delivered once")
+	})
+
+	t.Run("stop delivers queued messages", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		loopback, self := newLoopback(t)
+		received := make(chan *testutil.Message, 10)
+		loopback.Start(&channelReceiver{received})
+		for i := 0; i < 10; i++ {
+			require.NoError(t, loopback.SendMessage(ctx, self, newMessage()))
+		}
+		loopback.Stop()
+		require.Len(t, received, 10)
+		require.Error(t, loopback.SendMessage(ctx, self, newMessage()))
+	})
+}
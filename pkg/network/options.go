@@ -1,12 +1,21 @@
 package network
 
-import "github.com/libp2p/go-libp2p/core/protocol"
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
 
 type NetOpt func(*Settings)
 
 type Settings struct {
 	ProtocolPrefix     protocol.ID
 	SupportedProtocols []protocol.ID
+	Greylist           *Greylist
+	PublishEvents      bool
+	MaxMessageSize     int
+	MaxConcurrentDials int
+	DialBackoff        time.Duration
 }
 
 func Prefix(prefix protocol.ID) NetOpt {
@@ -20,3 +29,49 @@ func SupportedProtocols(protos []protocol.ID) NetOpt {
 		settings.SupportedProtocols = protos
 	}
 }
+
+// GreylistPeers records malformed inbound messages as violations on the given
+// greylist, and refuses inbound streams from greylisted peers. Sending to a
+// greylisted peer, including one that is denied, fails with
+// ErrPeerGreylisted without retrying. When a peer becomes greylisted it is
+// marked unresponsive, so receivers see it as disconnected.
+func GreylistPeers(greylist *Greylist) NetOpt {
+	return func(settings *Settings) {
+		settings.Greylist = greylist
+	}
+}
+
+// MaxMessageSize sets the largest serialized message accepted from a peer.
+// Reading a message stops as soon as its length prefix exceeds the limit, so
+// an oversized message is never buffered. The stream is reset, receivers get
+// ErrMessageTooLarge, and the peer is charged a violation if a Greylist is set.
+// Selectors from NewTransformingSelector also hold messages to the limit after
+// their incoming transform. The default is the libp2p network.MessageSizeMax.
+func MaxMessageSize(size int) NetOpt {
+	return func(settings *Settings) {
+		settings.MaxMessageSize = size
+	}
+}
+
+// DialLimits limits the dials the network makes to connect to peers. At most
+// maxConcurrent dials run at once across all peers (0 for no limit), and
+// concurrent attempts to connect to the same peer share a single dial, which
+// each caller stops waiting for when its own context is done. After a dial
+// fails, other than by being cancelled or timing out, connecting to the peer
+// fails with ErrDialBackoff until the backoff expires (0 for no backoff) or
+// the peer connects to us.
+func DialLimits(maxConcurrent int, backoff time.Duration) NetOpt {
+	return func(settings *Settings) {
+		settings.MaxConcurrentDials = maxConcurrent
+		settings.DialBackoff = backoff
+	}
+}
+
+// PublishEvents emits EvtSendFailed, EvtPeerGreylisted and EvtPeerThrottled
+// on the host's event bus, so other parts of an application can react to
+// them.
+func PublishEvents() NetOpt {
+	return func(settings *Settings) {
+		settings.PublishEvents = true
+	}
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var payloadLog = logging.Logger("protocolnetwork/payloads")
+
+// PayloadDump is a truncated dump of a serialized message
+type PayloadDump struct {
+	Peer     peer.ID
+	Protocol protocol.ID
+	Outgoing bool
+	// Size is the full size of the serialized message
+	Size int
+	// Hex is the hex encoding of up to the dumper's maximum number of bytes
+	Hex string
+}
+
+// PayloadSink receives payload dumps
+type PayloadSink func(PayloadDump)
+
+// PayloadDumper dumps the serialized messages exchanged with chosen peers,
+// for debugging interop issues without verbose logging for every peer. Peers
+// can be enabled and disabled at runtime. Its transforms should be installed
+// with NewTransformingSelector, outermost on outgoing messages and innermost
+// on incoming messages (see ChainTransforms), so dumps show the messages as
+// serialized by the MessageHandler.
+type PayloadDumper struct {
+	maxBytes int
+	sink     PayloadSink
+
+	lk    sync.RWMutex
+	peers map[peer.ID]struct{}
+	all   bool
+}
+
+// NewPayloadDumper creates a PayloadDumper that dumps up to maxBytes of each
+// message to the sink, or all of it if maxBytes is not positive. If the sink
+// is nil, dumps are logged at debug level to the protocolnetwork/payloads
+// logger. No peers are dumped until enabled.
+func NewPayloadDumper(maxBytes int, sink PayloadSink) *PayloadDumper {
+	if sink == nil {
+		sink = func(dump PayloadDump) {
+			direction := "incoming"
+			if dump.Outgoing {
+				direction = "outgoing"
+			}
+			payloadLog.Debugf("%s %s message with %s (%d bytes): %s", direction, dump.Protocol, dump.Peer, dump.Size, dump.Hex)
+		}
+	}
+	return &PayloadDumper{
+		maxBytes: maxBytes,
+		sink:     sink,
+		peers:    make(map[peer.ID]struct{}),
+	}
+}
+
+// Enable starts dumping messages exchanged with the peer
+func (pd *PayloadDumper) Enable(p peer.ID) {
+	pd.lk.Lock()
+	defer pd.lk.Unlock()
+	pd.peers[p] = struct{}{}
+}
+
+// Disable stops dumping messages exchanged with the peer
+func (pd *PayloadDumper) Disable(p peer.ID) {
+	pd.lk.Lock()
+	defer pd.lk.Unlock()
+	delete(pd.peers, p)
+}
+
+// EnableAll starts dumping messages exchanged with every peer
+func (pd *PayloadDumper) EnableAll() {
+	pd.lk.Lock()
+	defer pd.lk.Unlock()
+	pd.all = true
+}
+
+// DisableAll stops dumping messages for all peers, including those enabled
+// individually
+func (pd *PayloadDumper) DisableAll() {
+	pd.lk.Lock()
+	defer pd.lk.Unlock()
+	pd.all = false
+	pd.peers = make(map[peer.ID]struct{})
+}
+
+// Outgoing is the transform that dumps outgoing messages
+func (pd *PayloadDumper) Outgoing(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+	pd.dump(p, proto, true, data)
+	return data, nil
+}
+
+// Incoming is the transform that dumps incoming messages
+func (pd *PayloadDumper) Incoming(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+	pd.dump(p, proto, false, data)
+	return data, nil
+}
+
+func (pd *PayloadDumper) enabled(p peer.ID) bool {
+	pd.lk.RLock()
+	defer pd.lk.RUnlock()
+	if pd.all {
+		return true
+	}
+	_, ok := pd.peers[p]
+	return ok
+}
+
+func (pd *PayloadDumper) dump(p peer.ID, proto protocol.ID, outgoing bool, data []byte) {
+	if !pd.enabled(p) {
+		return
+	}
+	dumped := data
+	if pd.maxBytes > 0 && len(dumped) > pd.maxBytes {
+		dumped = dumped[:pd.maxBytes]
+	}
+	pd.sink(PayloadDump{
+		Peer:     p,
+		Protocol: proto,
+		Outgoing: outgoing,
+		Size:     len(data),
+		Hex:      hex.EncodeToString(dumped),
+	})
+}
@@ -0,0 +1,94 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
+)
+
+func TestPayloadDumper(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	msg := &testutil.Message{
+		Id:      testutil.RandomBytes(100),
+		Payload: testutil.RandomBytes(100),
+	}
+	selector := &MessageHandlerSelector{}
+	plain := new(bytes.Buffer)
+	require.NoError(t, selector.Select(testutil.ProtocolMockV2).ToNet(peers[0], msg, plain))
+	serialized, err := msgio.NewVarintReaderSize(plain, network.MessageSizeMax).ReadMsg()
+	require.NoError(t, err)
+
+	dumps := make(chan pn.PayloadDump, 2)
+	dumper := pn.NewPayloadDumper(8, func(dump pn.PayloadDump) { dumps <- dump })
+	// dumps should show messages as serialized, beneath any checksums
+	checksumOut, checksumIn := pn.FrameChecksums(testutil.ProtocolMockV2)
+	ts := pn.NewTransformingSelector[*testutil.Message](selector,
+		pn.OutgoingTransform(pn.ChainTransforms(dumper.Outgoing, checksumOut)),
+		pn.IncomingTransform(pn.ChainTransforms(checksumIn, dumper.Incoming)))
+	roundTrip := func(p int) {
+		buf := new(bytes.Buffer)
+		require.NoError(t, ts.Select(testutil.ProtocolMockV2).ToNet(peers[p], msg, buf))
+		received, err := ts.Select(testutil.ProtocolMockV2).FromNet(peers[p], buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, received)
+	}
+	expectDumps := func(p int) {
+		for _, outgoing := range []bool{true, false} {
+			var dump pn.PayloadDump
+			testutil.AssertReceive(ctx, t, dumps, &dump, "message was not dumped")
+			require.Equal(t, pn.PayloadDump{
+				Peer:     peers[p],
+				Protocol: testutil.ProtocolMockV2,
+				Outgoing: outgoing,
+				Size:     len(serialized),
+				Hex:      hex.EncodeToString(serialized[:8]),
+			}, dump)
+		}
+	}
+
+	roundTrip(0)
+	testutil.AssertChannelEmpty(t, dumps, "no peers are dumped by default")
+
+	dumper.Enable(peers[0])
+	roundTrip(0)
+	expectDumps(0)
+	roundTrip(1)
+	testutil.AssertChannelEmpty(t, dumps, "peer was not enabled")
+
+	dumper.Disable(peers[0])
+	roundTrip(0)
+	testutil.AssertChannelEmpty(t, dumps, "peer was disabled")
+
+	dumper.EnableAll()
+	roundTrip(1)
+	expectDumps(1)
+
+	dumper.DisableAll()
+	roundTrip(1)
+	testutil.AssertChannelEmpty(t, dumps, "all peers were disabled")
+}
+
+func TestPayloadDumperWithoutLimit(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	data := testutil.RandomBytes(100)
+	for _, maxBytes := range []int{0, -1} {
+		var dumped pn.PayloadDump
+		dumper := pn.NewPayloadDumper(maxBytes, func(dump pn.PayloadDump) { dumped = dump })
+		dumper.Enable(p)
+		_, err := dumper.Outgoing(p, testutil.ProtocolMockV2, data)
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(data), dumped.Hex)
+	}
+}
@@ -0,0 +1,217 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	msgio "github.com/libp2p/go-msgio"
+)
+
+// Transform transforms the serialized bytes of a message exchanged with a
+// peer over the given protocol, e.g. to encrypt, recompress or watermark it.
+// The transform may return a slice of data, but must not retain data itself.
+type Transform func(p peer.ID, proto protocol.ID, data []byte) ([]byte, error)
+
+// ChainTransforms combines transforms into one that applies each in turn,
+// stopping at the first error
+func ChainTransforms(transforms ...Transform) Transform {
+	return func(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+		var err error
+		for _, transform := range transforms {
+			if data, err = transform(p, proto, data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+}
+
+// TransformError is returned when a Transform fails
+type TransformError struct {
+	Peer     peer.ID
+	Protocol protocol.ID
+	Err      error
+}
+
+func (te TransformError) Error() string {
+	return fmt.Sprintf("transforming message for peer %s over %s: %s", te.Peer, te.Protocol, te.Err)
+}
+
+func (te TransformError) Unwrap() error {
+	return te.Err
+}
+
+// TransformOpt configures a transforming MessageHandlerSelector
+type TransformOpt func(*transformSettings)
+
+type transformSettings struct {
+	outgoing Transform
+	incoming Transform
+}
+
+// OutgoingTransform sets the transform applied to each message after it
+// is serialized and before it is written to the stream. The length prefix is
+// rewritten to match the transformed size.
+func OutgoingTransform(transform Transform) TransformOpt {
+	return func(settings *transformSettings) {
+		settings.outgoing = transform
+	}
+}
+
+// IncomingTransform sets the transform applied to each message read from the
+// stream before it is deserialized, typically reversing an OutgoingTransform
+// applied by the remote peer. If it fails, reading the message fails with a
+// TransformError, which the network reports to its receivers.
+func IncomingTransform(transform Transform) TransformOpt {
+	return func(settings *transformSettings) {
+		settings.incoming = transform
+	}
+}
+
+// NewTransformingSelector wraps a MessageHandlerSelector so that messages
+// pass through the configured transforms at serialization time. The wrapped
+// handlers must write varint length-prefixed messages, as the network
+// reads inbound messages that way.
+func NewTransformingSelector[MessageType Message[MessageType]](selector MessageHandlerSelector[MessageType], opts ...TransformOpt) MessageHandlerSelector[MessageType] {
+	ts := &transformingSelector[MessageType]{selector: selector, maxMessageSize: network.MessageSizeMax}
+	for _, opt := range opts {
+		opt(&ts.settings)
+	}
+	return ts
+}
+
+type transformingSelector[MessageType Message[MessageType]] struct {
+	selector       MessageHandlerSelector[MessageType]
+	settings       transformSettings
+	maxMessageSize int
+}
+
+// messageSizeLimiter is implemented by selectors that enforce a maximum
+// message size of their own, so a network can pass its MaxMessageSize on
+type messageSizeLimiter[MessageType Message[MessageType]] interface {
+	withMaxMessageSize(int) MessageHandlerSelector[MessageType]
+}
+
+// withMaxMessageSize returns a copy of the selector that limits messages,
+// before and after the incoming transform, to the given size
+func (ts *transformingSelector[MessageType]) withMaxMessageSize(size int) MessageHandlerSelector[MessageType] {
+	limited := *ts
+	limited.maxMessageSize = size
+	return &limited
+}
+
+func (ts *transformingSelector[MessageType]) Select(proto protocol.ID) MessageHandler[MessageType] {
+	return &transformingHandler[MessageType]{
+		handler:        ts.selector.Select(proto),
+		protocol:       proto,
+		settings:       &ts.settings,
+		maxMessageSize: ts.maxMessageSize,
+	}
+}
+
+type transformingHandler[MessageType Message[MessageType]] struct {
+	handler        MessageHandler[MessageType]
+	protocol       protocol.ID
+	settings       *transformSettings
+	maxMessageSize int
+}
+
+func (th *transformingHandler[MessageType]) FromNet(p peer.ID, r io.Reader) (MessageType, error) {
+	if th.settings.incoming == nil {
+		return th.handler.FromNet(p, r)
+	}
+	return th.FromMsgReader(p, msgio.NewVarintReaderSize(r, th.maxMessageSize))
+}
+
+func (th *transformingHandler[MessageType]) FromMsgReader(p peer.ID, r msgio.Reader) (MessageType, error) {
+	if th.settings.incoming == nil {
+		return th.handler.FromMsgReader(p, r)
+	}
+	return th.handler.FromMsgReader(p, &transformingReader{
+		Reader:         r,
+		peer:           p,
+		protocol:       th.protocol,
+		transform:      th.settings.incoming,
+		maxMessageSize: th.maxMessageSize,
+	})
+}
+
+func (th *transformingHandler[MessageType]) ToNet(p peer.ID, msg MessageType, w io.Writer) error {
+	if th.settings.outgoing == nil {
+		return th.handler.ToNet(p, msg, w)
+	}
+
+	// the serialized and transformed messages are staged in buffers from a
+	// size-classed pool, so transforming doesn't allocate fresh buffers for
+	// every message. Without an OutgoingTransform the handler writes straight
+	// to the stream, so there is nothing to pool.
+	serialized := &bufferWriter{pool: buffers}
+	defer serialized.release()
+	if err := th.handler.ToNet(p, msg, serialized); err != nil {
+		return err
+	}
+	size, n := binary.Uvarint(serialized.buf)
+	if n <= 0 {
+		return errors.New("serialized message has no valid length prefix")
+	}
+	body := serialized.buf[n:]
+	if size != uint64(len(body)) {
+		return fmt.Errorf("serialized message length prefix %d does not match message size %d", size, len(body))
+	}
+
+	transformed, err := th.settings.outgoing(p, th.protocol, body)
+	if err != nil {
+		return TransformError{Peer: p, Protocol: th.protocol, Err: err}
+	}
+
+	out := buffers.get(binary.MaxVarintLen64 + len(transformed))
+	defer buffers.put(out)
+	n = binary.PutUvarint(out, uint64(len(transformed)))
+	n += copy(out[n:], transformed)
+	_, err = w.Write(out[:n])
+	return err
+}
+
+// transformingReader applies a transform to each message read. The
+// underlying buffer is held until the transformed message is released, since
+// the transform may return a slice of it. Transformed messages are held to
+// the same size limit as messages on the wire, so e.g. a decompressing
+// transform can't be used to get around it.
+type transformingReader struct {
+	msgio.Reader
+	peer           peer.ID
+	protocol       protocol.ID
+	transform      Transform
+	maxMessageSize int
+	pending        []byte
+}
+
+func (tr *transformingReader) ReadMsg() ([]byte, error) {
+	msg, err := tr.Reader.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	transformed, err := tr.transform(tr.peer, tr.protocol, msg)
+	if err != nil {
+		tr.Reader.ReleaseMsg(msg)
+		return nil, TransformError{Peer: tr.peer, Protocol: tr.protocol, Err: err}
+	}
+	if len(transformed) > tr.maxMessageSize {
+		tr.Reader.ReleaseMsg(msg)
+		return nil, ErrMessageTooLarge
+	}
+	tr.pending = msg
+	return transformed, nil
+}
+
+func (tr *transformingReader) ReleaseMsg(_ []byte) {
+	if tr.pending != nil {
+		tr.Reader.ReleaseMsg(tr.pending)
+		tr.pending = nil
+	}
+}
@@ -0,0 +1,132 @@
+package network_test
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	msgio "github.com/libp2p/go-msgio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	pn "github.com/ipfs/go-protocolnetwork/pkg/network"
+)
+
+var transformHeader = []byte("transformed:")
+
+func addHeader(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+	return append(append([]byte{}, transformHeader...), data...), nil
+}
+
+func TestOutgoingTransform(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	msg := &testutil.Message{
+		Id:      testutil.RandomBytes(100),
+		Payload: testutil.RandomBytes(100),
+	}
+	selector := &MessageHandlerSelector{}
+
+	for _, proto := range testutil.DefaultProtocols {
+		t.Run(string(proto), func(t *testing.T) {
+			plain := new(bytes.Buffer)
+			require.NoError(t, selector.Select(proto).ToNet(p, msg, plain))
+			plainMsg, err := msgio.NewVarintReaderSize(plain, network.MessageSizeMax).ReadMsg()
+			require.NoError(t, err)
+
+			transformed := new(bytes.Buffer)
+			ts := pn.NewTransformingSelector[*testutil.Message](selector, pn.OutgoingTransform(addHeader))
+			require.NoError(t, ts.Select(proto).ToNet(p, msg, transformed))
+			transformedMsg, err := msgio.NewVarintReaderSize(transformed, network.MessageSizeMax).ReadMsg()
+			require.NoError(t, err)
+
+			require.Equal(t, append(append([]byte{}, transformHeader...), plainMsg...), transformedMsg)
+		})
+	}
+
+	t.Run("transform error", func(t *testing.T) {
+		errTransform := errors.New("cannot transform")
+		ts := pn.NewTransformingSelector[*testutil.Message](selector, pn.OutgoingTransform(func(peer.ID, protocol.ID, []byte) ([]byte, error) {
+			return nil, errTransform
+		}))
+		err := ts.Select(testutil.ProtocolMockV1).ToNet(p, msg, new(bytes.Buffer))
+		require.ErrorIs(t, err, errTransform)
+		var transformErr pn.TransformError
+		require.ErrorAs(t, err, &transformErr)
+		require.Equal(t, p, transformErr.Peer)
+		require.Equal(t, testutil.ProtocolMockV1, transformErr.Protocol)
+	})
+}
+
+func stripHeader(p peer.ID, proto protocol.ID, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, transformHeader) {
+		return nil, errors.New("missing header")
+	}
+	return data[len(transformHeader):], nil
+}
+
+func TestIncomingTransform(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	msg := &testutil.Message{
+		Id:      testutil.RandomBytes(100),
+		Payload: testutil.RandomBytes(100),
+	}
+	selector := &MessageHandlerSelector{}
+	ts := pn.NewTransformingSelector[*testutil.Message](selector, pn.OutgoingTransform(addHeader), pn.IncomingTransform(stripHeader))
+
+	for _, proto := range testutil.DefaultProtocols {
+		t.Run(string(proto), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, ts.Select(proto).ToNet(p, msg, buf))
+			received, err := ts.Select(proto).FromNet(p, bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, msg, received)
+
+			reader := msgio.NewVarintReaderSize(bytes.NewReader(buf.Bytes()), network.MessageSizeMax)
+			received, err = ts.Select(proto).FromMsgReader(p, reader)
+			require.NoError(t, err)
+			require.Equal(t, msg, received)
+		})
+	}
+
+	t.Run("transform error", func(t *testing.T) {
+		// a message sent without the outgoing transform cannot be reversed
+		buf := new(bytes.Buffer)
+		require.NoError(t, selector.Select(testutil.ProtocolMockV1).ToNet(p, msg, buf))
+		_, err := ts.Select(testutil.ProtocolMockV1).FromNet(p, buf)
+		var transformErr pn.TransformError
+		require.ErrorAs(t, err, &transformErr)
+		require.Equal(t, p, transformErr.Peer)
+		require.EqualError(t, transformErr.Err, "missing header")
+	})
+}
+
+func TestTransformBufferMetrics(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	msg := &testutil.Message{
+		Id:      testutil.RandomBytes(100),
+		Payload: testutil.RandomBytes(100),
+	}
+	ts := pn.NewTransformingSelector[*testutil.Message](&MessageHandlerSelector{}, pn.OutgoingTransform(addHeader))
+
+	handler := ts.Select(testutil.ProtocolMockV1)
+	hits := readMetric("buffer_pool_hits")
+	misses := readMetric("buffer_pool_misses")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, handler.ToNet(p, msg, new(bytes.Buffer)))
+	}
+	// buffers are returned to the pool after each message, so later messages
+	// of the same size reuse them
+	require.Greater(t, readMetric("buffer_pool_hits")-hits, readMetric("buffer_pool_misses")-misses)
+}
+
+func readMetric(name string) int64 {
+	value := expvar.Get("protocolnetwork.network").(*expvar.Map).Get(name)
+	if value == nil {
+		return 0
+	}
+	return value.(*expvar.Int).Value()
+}
@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/ipfs/go-protocolnetwork/internal/testutil"
 	"github.com/ipfs/go-protocolnetwork/pkg/notifications"
 )
@@ -144,3 +146,55 @@ func TestSubscribeWithData(t *testing.T) {
 	}
 
 }
+
+func TestSlowSubscribers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	slowSubs := make(chan notifications.Subscriber[Topic, Event], 1)
+	ps := notifications.NewPublisher(
+		notifications.SlowSubscriberThreshold[Topic, Event](10*time.Millisecond, 2),
+		notifications.OnSlowSubscriber(func(sub notifications.Subscriber[Topic, Event], latency time.Duration) {
+			slowSubs <- sub
+		}),
+		notifications.UnsubscribeSlowSubscribers[Topic, Event](),
+	)
+	ps.Startup()
+	defer ps.Shutdown()
+
+	fast := testutil.NewTestSubscriber[Topic, Event](3)
+	slow := &slowSubscriber{testutil.NewTestSubscriber[Topic, Event](3), 20 * time.Millisecond}
+	ps.Subscribe("t1", fast)
+	ps.Subscribe("t1", slow)
+
+	ps.Publish("t1", "hi1")
+	ps.Publish("t1", "hi2")
+	ps.Publish("t1", "hi3")
+
+	fast.ExpectEvents(ctx, t, []testutil.DispatchedEvent[Topic, Event]{
+		{Topic: "t1", Event: "hi1"},
+		{Topic: "t1", Event: "hi2"},
+		{Topic: "t1", Event: "hi3"},
+	})
+	var detected notifications.Subscriber[Topic, Event]
+	testutil.AssertReceive(ctx, t, slowSubs, &detected, "slow subscriber was not detected")
+	require.Equal(t, notifications.Subscriber[Topic, Event](slow), detected)
+
+	// the slow subscriber is unsubscribed after its second lagging event
+	slow.ExpectEvents(ctx, t, []testutil.DispatchedEvent[Topic, Event]{
+		{Topic: "t1", Event: "hi1"},
+		{Topic: "t1", Event: "hi2"},
+	})
+	slow.ExpectCloses(ctx, t, []Topic{"t1"})
+	slow.NoEventsReceived(t)
+}
+
+type slowSubscriber struct {
+	*testutil.TestSubscriber[Topic, Event]
+	delay time.Duration
+}
+
+func (ss *slowSubscriber) OnNext(topic Topic, ev Event) {
+	time.Sleep(ss.delay)
+	ss.TestSubscriber.OnNext(topic, ev)
+}
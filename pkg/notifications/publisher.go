@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 )
@@ -31,14 +32,59 @@ type publisher[Topic comparable, Event any] struct {
 	closed chan struct{}
 	cmds   []cmd[Topic, Event]
 	cmdsLk *sync.Cond
+
+	slowThreshold   time.Duration
+	slowStrikes     int
+	onSlow          SlowSubscriberHook[Topic, Event]
+	unsubscribeSlow bool
+}
+
+// SlowSubscriberHook is called when a subscriber has consistently lagged
+// in receiving events. It is called on the publisher's goroutine, so it should
+// not block.
+type SlowSubscriberHook[Topic comparable, Event any] func(sub Subscriber[Topic, Event], latency time.Duration)
+
+// Option configures the publisher
+type Option[Topic comparable, Event any] func(*publisher[Topic, Event])
+
+// SlowSubscriberThreshold enables slow subscriber detection: a subscriber whose
+// OnNext takes at least threshold to return on strikes consecutive events is
+// reported as lagging
+func SlowSubscriberThreshold[Topic comparable, Event any](threshold time.Duration, strikes int) Option[Topic, Event] {
+	return func(ps *publisher[Topic, Event]) {
+		ps.slowThreshold = threshold
+		ps.slowStrikes = strikes
+	}
+}
+
+// OnSlowSubscriber specifies a hook to run when a lagging subscriber is detected
+func OnSlowSubscriber[Topic comparable, Event any](onSlow SlowSubscriberHook[Topic, Event]) Option[Topic, Event] {
+	return func(ps *publisher[Topic, Event]) {
+		ps.onSlow = onSlow
+	}
+}
+
+// UnsubscribeSlowSubscribers causes lagging subscribers to be unsubscribed from
+// all topics once detected, to protect the publisher from pathological
+// subscribers
+func UnsubscribeSlowSubscribers[Topic comparable, Event any]() Option[Topic, Event] {
+	return func(ps *publisher[Topic, Event]) {
+		ps.unsubscribeSlow = true
+	}
 }
 
 // NewPublisher returns a new message event publisher
-func NewPublisher[Topic comparable, Event any]() Publisher[Topic, Event] {
+func NewPublisher[Topic comparable, Event any](options ...Option[Topic, Event]) Publisher[Topic, Event] {
 	ps := &publisher[Topic, Event]{
 		cmdsLk: sync.NewCond(&sync.Mutex{}),
 		closed: make(chan struct{}),
 	}
+	for _, option := range options {
+		option(ps)
+	}
+	if ps.slowStrikes < 1 {
+		ps.slowStrikes = 1
+	}
 	return ps
 }
 
@@ -113,8 +159,10 @@ func (ps *publisher[Topic, Event]) Unsubscribe(sub Subscriber[Topic, Event]) boo
 
 func (ps *publisher[Topic, Event]) start() {
 	reg := subscriberRegistry[Topic, Event]{
-		topics:    make(map[Topic]map[Subscriber[Topic, Event]]struct{}),
-		revTopics: make(map[Subscriber[Topic, Event]]map[Topic]struct{}),
+		topics:      make(map[Topic]map[Subscriber[Topic, Event]]struct{}),
+		revTopics:   make(map[Subscriber[Topic, Event]]map[Topic]struct{}),
+		slowStrikes: make(map[Subscriber[Topic, Event]]int),
+		ps:          ps,
 	}
 
 loop:
@@ -154,8 +202,10 @@ loop:
 }
 
 type subscriberRegistry[Topic comparable, Event any] struct {
-	topics    map[Topic]map[Subscriber[Topic, Event]]struct{}
-	revTopics map[Subscriber[Topic, Event]]map[Topic]struct{}
+	topics      map[Topic]map[Subscriber[Topic, Event]]struct{}
+	revTopics   map[Subscriber[Topic, Event]]map[Topic]struct{}
+	slowStrikes map[Subscriber[Topic, Event]]int
+	ps          *publisher[Topic, Event]
 }
 
 func (reg *subscriberRegistry[Topic, Event]) add(topic Topic, sub Subscriber[Topic, Event]) {
@@ -172,7 +222,32 @@ func (reg *subscriberRegistry[Topic, Event]) add(topic Topic, sub Subscriber[Top
 
 func (reg *subscriberRegistry[Topic, Event]) send(topic Topic, msg Event) {
 	for sub := range reg.topics[topic] {
+		if reg.ps.slowThreshold == 0 {
+			sub.OnNext(topic, msg)
+			continue
+		}
+		start := time.Now()
 		sub.OnNext(topic, msg)
+		reg.recordLatency(sub, time.Since(start))
+	}
+}
+
+func (reg *subscriberRegistry[Topic, Event]) recordLatency(sub Subscriber[Topic, Event], latency time.Duration) {
+	if latency < reg.ps.slowThreshold {
+		delete(reg.slowStrikes, sub)
+		return
+	}
+	reg.slowStrikes[sub]++
+	if reg.slowStrikes[sub] < reg.ps.slowStrikes {
+		return
+	}
+	delete(reg.slowStrikes, sub)
+	log.Warnw("subscriber is consistently slow to receive events", "latency", latency, "strikes", reg.ps.slowStrikes)
+	if reg.ps.onSlow != nil {
+		reg.ps.onSlow(sub, latency)
+	}
+	if reg.ps.unsubscribeSlow {
+		reg.removeSubscriber(sub)
 	}
 }
 
@@ -206,6 +281,7 @@ func (reg *subscriberRegistry[Topic, Event]) remove(topic Topic, sub Subscriber[
 
 	if len(reg.revTopics[sub]) == 0 {
 		delete(reg.revTopics, sub)
+		delete(reg.slowStrikes, sub)
 	}
 
 	sub.OnClose(topic)
@@ -1,6 +1,10 @@
 package notifications
 
-// Subscriber is a subscriber that can receive events
+// Subscriber is a subscriber that can receive events. OnClose is the terminal
+// event for a topic: it is called on the publisher's goroutine exactly once for
+// each topic a subscriber was subscribed to, whether the topic is closed, the
+// subscriber is unsubscribed (including as a slow subscriber), or the publisher
+// shuts down, and no further events for that topic follow it
 type Subscriber[Topic comparable, Event any] interface {
 	OnNext(Topic, Event)
 	OnClose(Topic)
@@ -16,9 +16,14 @@ type PeerAddedHook[PeerHandler any] func(PeerHandler)
 // PeerRemovedHook is called when a peer handler will no longer be tracked
 type PeerRemovedHook[PeerHandler any] func(PeerHandler)
 
+// Migrator is implemented by peer handlers that can be moved to a new peer ID
+type Migrator interface {
+	Migrate(peer.ID)
+}
+
 // PeerManager manages a pool of handlers on behalf of connected peers
 type PeerManager[PeerHandler any] struct {
-	peerHandlers   map[peer.ID]PeerHandler
+	peerHandlers   map[peer.ID]*peerEntry[PeerHandler]
 	peerHandlersLk sync.RWMutex
 
 	createPeerHandler PeerHandlerFactory[PeerHandler]
@@ -27,6 +32,13 @@ type PeerManager[PeerHandler any] struct {
 	ctx               context.Context
 }
 
+// peerEntry tracks the peer a handler is currently registered under, which
+// changes if it is migrated
+type peerEntry[PeerHandler any] struct {
+	p       peer.ID
+	handler PeerHandler
+}
+
 // Option configures the PeerManager
 type Option[PeerHandler any] func(*PeerManager[PeerHandler])
 
@@ -47,7 +59,7 @@ func OnPeerRemovedHook[PeerHandler any](onPeerRemoved PeerRemovedHook[PeerHandle
 // New creates a new PeerManager, given a context and a PeerHandlerFactory.
 func New[PeerHandler any](ctx context.Context, createPeerHandler PeerHandlerFactory[PeerHandler], options ...Option[PeerHandler]) *PeerManager[PeerHandler] {
 	pm := &PeerManager[PeerHandler]{
-		peerHandlers:      make(map[peer.ID]PeerHandler),
+		peerHandlers:      make(map[peer.ID]*peerEntry[PeerHandler]),
 		createPeerHandler: createPeerHandler,
 		ctx:               ctx,
 	}
@@ -68,6 +80,20 @@ func (pm *PeerManager[PeerHandler]) ConnectedPeers() []peer.ID {
 	return peers
 }
 
+// EachHandler calls fn with each peer's handler. The handlers are collected
+// first, so fn may call back into the PeerManager.
+func (pm *PeerManager[PeerHandler]) EachHandler(fn func(peer.ID, PeerHandler)) {
+	pm.peerHandlersLk.RLock()
+	entries := make([]peerEntry[PeerHandler], 0, len(pm.peerHandlers))
+	for _, entry := range pm.peerHandlers {
+		entries = append(entries, *entry)
+	}
+	pm.peerHandlersLk.RUnlock()
+	for _, entry := range entries {
+		fn(entry.p, entry.handler)
+	}
+}
+
 // Connected is called to add a new peer to the pool
 func (pm *PeerManager[PeerHandler]) Connected(p peer.ID) {
 	pm.peerHandlersLk.Lock()
@@ -78,7 +104,7 @@ func (pm *PeerManager[PeerHandler]) Connected(p peer.ID) {
 // Disconnected is called to remove a peer from the pool.
 func (pm *PeerManager[PeerHandler]) Disconnected(p peer.ID) {
 	pm.peerHandlersLk.Lock()
-	ph, ok := pm.peerHandlers[p]
+	entry, ok := pm.peerHandlers[p]
 	if !ok {
 		pm.peerHandlersLk.Unlock()
 		return
@@ -88,43 +114,79 @@ func (pm *PeerManager[PeerHandler]) Disconnected(p peer.ID) {
 	pm.peerHandlersLk.Unlock()
 
 	if pm.onPeerRemoved != nil {
-		pm.onPeerRemoved(ph)
+		pm.onPeerRemoved(entry.handler)
 	}
 }
 
+// Migrate moves the handler for one peer ID to another, e.g. when a peer
+// re-identifies, so its pending work isn't dropped. The handler must implement
+// Migrator. It returns false if there is no handler for from, the handler
+// cannot migrate, or there is already a handler for to.
+func (pm *PeerManager[PeerHandler]) Migrate(from, to peer.ID) bool {
+	pm.peerHandlersLk.Lock()
+	entry, ok := pm.peerHandlers[from]
+	if !ok {
+		pm.peerHandlersLk.Unlock()
+		return false
+	}
+	migrator, ok := any(entry.handler).(Migrator)
+	if !ok {
+		pm.peerHandlersLk.Unlock()
+		return false
+	}
+	if _, exists := pm.peerHandlers[to]; exists {
+		pm.peerHandlersLk.Unlock()
+		return false
+	}
+	delete(pm.peerHandlers, from)
+	entry.p = to
+	pm.peerHandlers[to] = entry
+	pm.peerHandlersLk.Unlock()
+
+	migrator.Migrate(to)
+	return true
+}
+
 // GetHandler returns the process for the given peer
 func (pm *PeerManager[PeerHandler]) GetHandler(
 	p peer.ID) PeerHandler {
 	// Usually this this is just a read
 	pm.peerHandlersLk.RLock()
-	ph, ok := pm.peerHandlers[p]
+	entry, ok := pm.peerHandlers[p]
 	if ok {
 		pm.peerHandlersLk.RUnlock()
-		return ph
+		return entry.handler
 	}
 	pm.peerHandlersLk.RUnlock()
 	// but sometimes it involves a create (we still need to do get or create cause it's possible
 	// another writer grabbed the Lock first and made the process)
 	pm.peerHandlersLk.Lock()
-	ph = pm.getOrCreate(p)
+	ph := pm.getOrCreate(p)
 	pm.peerHandlersLk.Unlock()
 	return ph
 }
 
 func (pm *PeerManager[PeerHandler]) getOrCreate(p peer.ID) PeerHandler {
-	pqi, ok := pm.peerHandlers[p]
+	entry, ok := pm.peerHandlers[p]
 	if !ok {
-		pqi = pm.createPeerHandler(pm.ctx, p, pm.onQueueShutdown)
+		entry = &peerEntry[PeerHandler]{p: p}
+		entry.handler = pm.createPeerHandler(pm.ctx, p, func(peer.ID) {
+			pm.onQueueShutdown(entry)
+		})
 		if pm.onPeerAdded != nil {
-			pm.onPeerAdded(pqi)
+			pm.onPeerAdded(entry.handler)
 		}
-		pm.peerHandlers[p] = pqi
+		pm.peerHandlers[p] = entry
 	}
-	return pqi
+	return entry.handler
 }
 
-func (pm *PeerManager[PeerHandler]) onQueueShutdown(p peer.ID) {
+// onQueueShutdown removes a handler that has shut down, wherever it is now
+// registered, without touching any newer handler for the same peer
+func (pm *PeerManager[PeerHandler]) onQueueShutdown(entry *peerEntry[PeerHandler]) {
 	pm.peerHandlersLk.Lock()
 	defer pm.peerHandlersLk.Unlock()
-	delete(pm.peerHandlers, p)
+	if pm.peerHandlers[entry.p] == entry {
+		delete(pm.peerHandlers, entry.p)
+	}
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/ipfs/go-protocolnetwork/internal/testutil"
 	"github.com/ipfs/go-protocolnetwork/pkg/peermanager"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
 )
 
 type fakePeerProcess struct {
@@ -15,6 +16,46 @@ type fakePeerProcess struct {
 func (fp *fakePeerProcess) Startup()  {}
 func (fp *fakePeerProcess) Shutdown() {}
 
+type migratingPeerProcess struct {
+	fakePeerProcess
+	onShutdown func(peer.ID)
+	migratedTo peer.ID
+}
+
+func (mp *migratingPeerProcess) Migrate(p peer.ID) {
+	mp.migratedTo = p
+}
+
+func TestMigratingPeers(t *testing.T) {
+	ctx := context.Background()
+	peerProcessFactory := func(ctx context.Context, p peer.ID, onShutdown func(peer.ID)) *migratingPeerProcess {
+		return &migratingPeerProcess{onShutdown: onShutdown}
+	}
+
+	tp := testutil.GeneratePeers(3)
+	peer1, peer2, peer3 := tp[0], tp[1], tp[2]
+	peerManager := peermanager.New(ctx, peerProcessFactory)
+
+	process := peerManager.GetHandler(peer1)
+	require.True(t, peerManager.Migrate(peer1, peer2))
+	require.Equal(t, peer2, process.migratedTo)
+	require.Same(t, process, peerManager.GetHandler(peer2))
+	testutil.RefuteContainsPeer(t, peerManager.ConnectedPeers(), peer1)
+
+	// cannot migrate an unknown peer, or onto a peer that has a handler
+	require.False(t, peerManager.Migrate(peer1, peer3))
+	peerManager.Connected(peer3)
+	require.False(t, peerManager.Migrate(peer2, peer3))
+
+	// a new handler for the old peer is unaffected when the migrated one shuts down
+	newProcess := peerManager.GetHandler(peer1)
+	process.onShutdown(peer1)
+	connectedPeers := peerManager.ConnectedPeers()
+	testutil.RefuteContainsPeer(t, connectedPeers, peer2)
+	testutil.AssertContainsPeer(t, connectedPeers, peer1)
+	require.Same(t, newProcess, peerManager.GetHandler(peer1))
+}
+
 func TestAddingAndRemovingPeers(t *testing.T) {
 	ctx := context.Background()
 	peerProcessFatory := func(ctx context.Context, p peer.ID, onShutdown func(peer.ID)) *fakePeerProcess {
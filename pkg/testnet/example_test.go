@@ -0,0 +1,85 @@
+package testnet_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	delay "github.com/ipfs/go-ipfs-delay"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeuemanager"
+	"github.com/ipfs/go-protocolnetwork/pkg/network"
+	"github.com/ipfs/go-protocolnetwork/pkg/testnet"
+)
+
+// Example wires a requester and a responder together over the in-memory
+// virtual network. The responder serves payloads from a simple key/value store,
+// and the requester sends its requests through a MessageQueueManager.
+func Example() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	net := testnet.VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+	requesterID, err := tnet.RandIdentity()
+	if err != nil {
+		panic(err)
+	}
+	responderID, err := tnet.RandIdentity()
+	if err != nil {
+		panic(err)
+	}
+	requester := net.Adapter(requesterID)
+	responder := net.Adapter(responderID)
+
+	// the responder looks up the requested key and sends back the value
+	store := map[string][]byte{"hello": []byte("world")}
+	responder.Start(&exampleReceiver{onMessage: func(ctx context.Context, from peer.ID, request *testutil.Message) {
+		response := &testutil.Message{Id: request.Id, Payload: store[string(request.Id)]}
+		if err := responder.SendMessage(ctx, from, response); err != nil {
+			fmt.Println("error responding:", err)
+		}
+	}})
+	defer responder.Stop()
+
+	responses := make(chan *testutil.Message, 1)
+	requester.Start(&exampleReceiver{onMessage: func(ctx context.Context, from peer.ID, response *testutil.Message) {
+		responses <- response
+	}})
+	defer requester.Stop()
+
+	// the requester sends via a message queue per peer
+	opts := &network.MessageSenderOpts{MaxRetries: 3, SendTimeout: time.Second, SendErrorBackoff: 100 * time.Millisecond}
+	queues := messagequeuemanager.NewMessageQueueManager(ctx, func(ctx context.Context, p peer.ID, onShutdown func(peer.ID)) messagequeuemanager.MessageQueue[func(*testutil.SingleBuilder)] {
+		return messagequeue.New[*testutil.Message, func(*testutil.SingleBuilder)](ctx, p, requester, testutil.NewMessageBuilder(), opts, nil, func() { onShutdown(p) })
+	})
+	queues.BuildMessage(responderID.ID(), func(b *testutil.SingleBuilder) {
+		b.SetID([]byte("hello"))
+	})
+
+	select {
+	case response := <-responses:
+		fmt.Printf("received %s: %s\n", response.Id, response.Payload)
+	case <-ctx.Done():
+		fmt.Println("no response received")
+	}
+	queues.Disconnected(responderID.ID())
+
+	// Output:
+	// received hello: world
+}
+
+type exampleReceiver struct {
+	onMessage func(ctx context.Context, from peer.ID, incoming *testutil.Message)
+}
+
+func (er *exampleReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming *testutil.Message) {
+	er.onMessage(ctx, sender, incoming)
+}
+
+func (er *exampleReceiver) ReceiveError(peer.ID, error) {}
+func (er *exampleReceiver) PeerConnected(peer.ID)       {}
+func (er *exampleReceiver) PeerDisconnected(peer.ID)    {}
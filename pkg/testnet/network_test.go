@@ -7,6 +7,7 @@ import (
 
 	delay "github.com/ipfs/go-ipfs-delay"
 	"github.com/ipfs/go-protocolnetwork/internal/testutil"
+	"github.com/ipfs/go-protocolnetwork/pkg/messagequeue/messagequeuetest"
 	"github.com/ipfs/go-protocolnetwork/pkg/network"
 	"github.com/stretchr/testify/require"
 
@@ -93,3 +94,26 @@ func (lam *lambdaImpl) PeerConnected(p peer.ID) {
 func (lam *lambdaImpl) PeerDisconnected(peer.ID) {
 	// TODO
 }
+
+func TestVirtualNetworkConformance(t *testing.T) {
+	messagequeuetest.TestMessageNetwork(t, func(t *testing.T) messagequeuetest.Harness[*testutil.Message] {
+		net := VirtualNetwork[*testutil.Message](delay.Fixed(0), testutil.DefaultProtocols, &testutil.IPLDMessageHandler{})
+		sender := net.Adapter(tnet.RandIdentityOrFatal(t))
+		receiverPeer := tnet.RandIdentityOrFatal(t)
+		receiver := net.Adapter(receiverPeer)
+		received := make(chan *testutil.Message, 16)
+		receiver.Start(lambda(func(ctx context.Context, p peer.ID, incoming *testutil.Message) {
+			received <- incoming
+		}))
+		t.Cleanup(receiver.Stop)
+		return messagequeuetest.Harness[*testutil.Message]{
+			Network:         sender,
+			Peer:            receiverPeer.ID(),
+			UnreachablePeer: tnet.RandIdentityOrFatal(t).ID(),
+			Received:        received,
+			NewMessage: func() *testutil.Message {
+				return &testutil.Message{Id: testutil.RandomBytes(100), Payload: testutil.RandomBytes(100)}
+			},
+		}
+	})
+}
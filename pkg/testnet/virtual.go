@@ -21,6 +21,9 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 )
 
+// ErrNoSuchPeer is returned when a peer has no adapter on the virtual network
+var ErrNoSuchPeer = errors.New("no such peer in network")
+
 // VirtualNetwork generates a new testnet instance - a fake network that
 // is used to simulate sending messages.
 func VirtualNetwork[MessageType network.Message[MessageType]](
@@ -175,7 +178,7 @@ func (n *virtualnetwork[MessageType]) SendMessage(
 
 	receiver, ok := n.clients[to]
 	if !ok {
-		return errors.New("cannot locate peer on network")
+		return ErrNoSuchPeer
 	}
 
 	// nb: terminate the context since the context wouldn't actually be passed
@@ -261,6 +264,25 @@ func (nc *networkClient[MessageType]) ConnectionManager() network.ConnManager {
 	return &connmgr.NullConnMgr{}
 }
 
+func (nc *networkClient[MessageType]) PeerInfo(p peer.ID) network.PeerInfo {
+	nc.network.mu.Lock()
+	defer nc.network.mu.Unlock()
+	otherClient, ok := nc.network.clients[p]
+	if !ok {
+		return network.PeerInfo{}
+	}
+	var info network.PeerInfo
+	for _, proto := range nc.supportedProtocols {
+		for _, otherProto := range otherClient.receiver.supportedProtocols {
+			if proto == otherProto {
+				info.Protocols = append(info.Protocols, proto)
+				break
+			}
+		}
+	}
+	return info
+}
+
 type messagePasser[MessageType network.Message[MessageType]] struct {
 	net    *networkClient[MessageType]
 	target peer.ID
@@ -306,7 +328,7 @@ func (nc *networkClient[MessageType]) ConnectTo(_ context.Context, p peer.ID) er
 	otherClient, ok := nc.network.clients[p]
 	if !ok {
 		nc.network.mu.Unlock()
-		return errors.New("no such peer in network")
+		return ErrNoSuchPeer
 	}
 
 	tag := tagForPeers(nc.local, p)
@@ -329,7 +351,7 @@ func (nc *networkClient[MessageType]) DisconnectFrom(_ context.Context, p peer.I
 
 	otherClient, ok := nc.network.clients[p]
 	if !ok {
-		return errors.New("no such peer in network")
+		return ErrNoSuchPeer
 	}
 
 	tag := tagForPeers(nc.local, p)